@@ -0,0 +1,423 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/resolver"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoEndpoints = errors.New("no endpoint available")
+
+// Endpoint is a server address of a BalancedClient
+type Endpoint struct {
+	Address string
+
+	pending      int64 // calls in flight, accessed atomically
+	connMu       sync.Mutex
+	client       *Client
+	removed      bool       // no longer resolved, closed once idle
+	mutex        sync.Mutex // protects the health below
+	failures     int        // consecutive failed calls
+	ejectedUntil time.Time  // the endpoint gets no calls before
+	breakers     *breakers  // circuit breakers, kept across reconnects
+}
+
+// Pending returns the number of calls in flight on the endpoint
+func (ep *Endpoint) Pending() int64 {
+	return atomic.LoadInt64(&ep.pending)
+}
+
+// Ejected reports whether the endpoint is ejected for failing
+func (ep *Endpoint) Ejected() bool {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	return time.Now().Before(ep.ejectedUntil)
+}
+
+// BalanceConfig configures a BalancedClient
+type BalanceConfig struct {
+	Balancer    Balancer      // picks the endpoint of each call, nil means RoundRobinBalancer
+	MaxFailures int           // consecutive failures ejecting an endpoint, 0 means 3
+	EjectTime   time.Duration // how long an endpoint stays ejected, 0 means 10s
+}
+
+// BalancedClient spreads the calls of a service over several server addresses
+type BalancedClient struct {
+	mutex       sync.RWMutex
+	endpoints   []*Endpoint
+	closed      bool
+	config      BalanceConfig
+	network     string
+	serviceName string
+	definition  interface{}
+	opts        []Option
+	options     options            // settings of the balanced proxy
+	cancel      context.CancelFunc // stops the resolver
+}
+
+// NewBalancedClient returns a client routing each call to one of the addresses
+// picked by config.Balancer. Endpoints failing at the transport level are
+// ejected for a while. The GetService instance is used the same way as the
+// one of NewClient, opts apply to the Client of every endpoint.
+func NewBalancedClient(network string, addresses []string, serviceName string, definition interface{},
+	config BalanceConfig, opts ...Option) *BalancedClient {
+	if config.Balancer == nil {
+		config.Balancer = RoundRobinBalancer()
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 3
+	}
+	if config.EjectTime <= 0 {
+		config.EjectTime = 10 * time.Second
+	}
+
+	b := &BalancedClient{
+		config:      config,
+		network:     network,
+		serviceName: serviceName,
+		opts:        opts,
+		options:     newOptions(opts),
+	}
+	b.definition = buildProxy(definition, serviceName, b.invoke, &b.options)
+	b.SetAddresses(addresses)
+	return b
+}
+
+// NewResolvedClient returns a balanced client whose endpoints follow the
+// addresses r resolves for serviceName. It waits for the first set of addresses.
+func NewResolvedClient(network string, r resolver.Resolver, serviceName string, definition interface{},
+	config BalanceConfig, opts ...Option) (*BalancedClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := r.Resolve(ctx, serviceName)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	addresses, ok := <-updates
+	if !ok {
+		cancel()
+		return nil, ErrNoEndpoints
+	}
+
+	b := NewBalancedClient(network, addresses, serviceName, definition, config, opts...)
+	b.cancel = cancel
+	go func() {
+		for addresses := range updates {
+			b.SetAddresses(addresses)
+		}
+	}()
+	return b, nil
+}
+
+// SetAddresses replaces the endpoints of the client. New addresses are
+// dialed, the connections of removed ones are closed once their calls finish.
+func (b *BalancedClient) SetAddresses(addresses []string) {
+	wanted := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		wanted[address] = true
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	endpoints := make([]*Endpoint, 0, len(addresses))
+	var added, removed []*Endpoint
+	for _, ep := range b.endpoints {
+		if wanted[ep.Address] {
+			endpoints = append(endpoints, ep)
+			delete(wanted, ep.Address)
+		} else {
+			removed = append(removed, ep)
+		}
+	}
+	for _, address := range addresses {
+		if wanted[address] {
+			ep := &Endpoint{Address: address}
+			if b.options.breaker != nil {
+				ep.breakers = newBreakers(b.options.breaker, address)
+			}
+			endpoints = append(endpoints, ep)
+			added = append(added, ep)
+			delete(wanted, address)
+		}
+	}
+	b.endpoints = endpoints
+	b.mutex.Unlock()
+
+	for _, ep := range removed {
+		ep.retire()
+	}
+	for _, ep := range added {
+		if _, err := b.connect(ep); err != nil {
+			log.Print("ferry.BalancedClient: Dial Fail: ", err.Error())
+			b.report(ep, err)
+		}
+	}
+}
+
+// GetService returns a instance which represents the remote service definition
+func (b *BalancedClient) GetService() interface{} {
+	return b.definition
+}
+
+// Endpoints returns the endpoints of the client
+func (b *BalancedClient) Endpoints() []*Endpoint {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return append([]*Endpoint(nil), b.endpoints...)
+}
+
+// Close closes the connections to all the endpoints
+func (b *BalancedClient) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrShutdown
+	}
+	b.closed = true
+	endpoints := b.endpoints
+	b.mutex.Unlock()
+
+	if b.cancel != nil {
+		b.cancel()
+	}
+	for _, ep := range endpoints {
+		ep.close()
+	}
+	return nil
+}
+
+// connect returns the client of the endpoint, dialing it if needed
+func (b *BalancedClient) connect(ep *Endpoint) (*Client, error) {
+	if c, err := ep.current(); c != nil || err != nil {
+		return c, err
+	}
+
+	conn, err := net.Dial(b.network, ep.Address)
+	if err != nil {
+		return nil, err
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial(b.network, ep.Address)
+	}
+	opts := append([]Option{WithDialer(dial)}, b.opts...)
+	opts = append(opts, withBreakers(ep.breakers))
+	c := NewClient(conn, b.serviceName, b.definition, opts...)
+
+	ep.connMu.Lock()
+	if ep.removed || (ep.client != nil && ep.client.State() != StateShutdown) {
+		// removed or connected by another call meanwhile
+		ep.connMu.Unlock()
+		c.Close()
+		return ep.current()
+	}
+	ep.client = c
+	ep.connMu.Unlock()
+	return c, nil
+}
+
+// current returns the usable client of the endpoint, if any.
+// A removed endpoint keeps serving the calls picked before its removal.
+func (ep *Endpoint) current() (*Client, error) {
+	ep.connMu.Lock()
+	defer ep.connMu.Unlock()
+
+	if ep.client != nil && ep.client.State() != StateShutdown {
+		return ep.client, nil
+	}
+	if ep.removed {
+		return nil, ErrNoEndpoints
+	}
+	return nil, nil
+}
+
+// circuitOpen reports whether the calls of the method fail fast on the endpoint
+func (ep *Endpoint) circuitOpen(serviceName, methodName string) bool {
+	return ep.breakers.circuitOpen(serviceName, methodName)
+}
+
+// isRemoved reports whether the endpoint was removed by SetAddresses
+func (ep *Endpoint) isRemoved() bool {
+	ep.connMu.Lock()
+	defer ep.connMu.Unlock()
+	return ep.removed
+}
+
+// close closes the connection to the endpoint
+func (ep *Endpoint) close() {
+	ep.connMu.Lock()
+	c := ep.client
+	ep.client = nil
+	ep.connMu.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+// retire marks the endpoint removed and closes it if no call is in flight
+func (ep *Endpoint) retire() {
+	ep.connMu.Lock()
+	ep.removed = true
+	ep.connMu.Unlock()
+
+	if ep.Pending() == 0 {
+		ep.close()
+	}
+}
+
+// report records the outcome of a call on the endpoint
+// and ejects the endpoint after too many failures
+func (b *BalancedClient) report(ep *Endpoint, err error) {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+
+	if !isEndpointFailure(err) {
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	if ep.failures >= b.config.MaxFailures {
+		log.Print("ferry.BalancedClient: eject endpoint ", ep.Address, ": ", err.Error())
+		ep.failures = 0
+		ep.ejectedUntil = time.Now().Add(b.config.EjectTime)
+	}
+}
+
+// isEndpointFailure reports whether err shows the endpoint can't serve calls,
+// errors returned by the methods themselves don't count
+func isEndpointFailure(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded ||
+		err == ErrCircuitOpen || err == ErrNoEndpoints {
+		return false
+	}
+	if e, ok := err.(*message.Error); ok {
+		return e.Code == message.CodeServiceUnavailable || e.Code == message.CodeInternal
+	}
+	return true
+}
+
+// pick chooses the endpoint of a call among the healthy ones, those neither
+// ejected nor with an open circuit. If there are none any endpoint may be picked.
+// exclude, if not nil, is never picked. The call is counted as pending on the
+// endpoint before SetAddresses can retire it, the caller must release it.
+func (b *BalancedClient) pick(call *CallInfo, exclude *Endpoint) (*Endpoint, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return nil, ErrShutdown
+	}
+	candidates := make([]*Endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		if ep != exclude {
+			candidates = append(candidates, ep)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	healthy := make([]*Endpoint, 0, len(candidates))
+	for _, ep := range candidates {
+		if !ep.Ejected() && !ep.circuitOpen(call.ServiceName, call.MethodName) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = candidates
+	}
+	ep := b.config.Balancer.Pick(healthy, call)
+	if ep == nil {
+		return nil, ErrNoEndpoints
+	}
+	atomic.AddInt64(&ep.pending, 1)
+	return ep, nil
+}
+
+// release ends a call picked on ep, a retired endpoint is closed
+// once its last call ends
+func (b *BalancedClient) release(ep *Endpoint) {
+	if atomic.AddInt64(&ep.pending, -1) == 0 && ep.isRemoved() {
+		ep.close()
+	}
+}
+
+// invoke sends a RPC call to the endpoint picked by the balancer
+func (b *BalancedClient) invoke(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+	call := &CallInfo{ServiceName: serviceName, MethodName: methodName, Args: args}
+	ep, err := b.pick(call, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hedge := callConfig(ctx).hedge; hedge > 0 {
+		return b.hedge(ctx, hedge, ep, call)
+	}
+	return b.invokeEndpoint(ctx, ep, serviceName, methodName, args)
+}
+
+// hedge sends the call to ep and, if it hasn't answered after delay, a duplicate
+// to another endpoint. The first successful response wins and the other call is
+// canceled, the error of a failed call is returned once no call is left running.
+func (b *BalancedClient) hedge(ctx context.Context, delay time.Duration, ep *Endpoint, call *CallInfo) ([]json.RawMessage, error) {
+	// canceling the context makes the Client of the loser send a cancel message
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		replys []json.RawMessage
+		err    error
+	}
+	results := make(chan result, 2)
+	send := func(ep *Endpoint) {
+		go func() {
+			replys, err := b.invokeEndpoint(ctx, ep, call.ServiceName, call.MethodName, call.Args)
+			results <- result{replys, err}
+		}()
+	}
+
+	send(ep)
+	running := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.replys, nil
+			}
+			err = r.err
+		case <-timer.C:
+			if second, perr := b.pick(call, ep); perr == nil {
+				send(second)
+				running++
+			}
+		}
+	}
+	return nil, err
+}
+
+// invokeEndpoint sends a RPC call to ep, picked by pick
+func (b *BalancedClient) invokeEndpoint(ctx context.Context, ep *Endpoint, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+	defer b.release(ep)
+
+	c, err := b.connect(ep)
+	if err != nil {
+		b.report(ep, err)
+		return nil, err
+	}
+	replys, err := c.invoke(ctx, serviceName, methodName, args)
+	b.report(ep, err)
+	return replys, err
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"github.com/sunlidea/ferry/server"
+	"testing"
+	"time"
+)
+
+// Node reports the name of the server it runs on
+type Node struct {
+	name     string
+	delay    time.Duration // latency of Slow
+	canceled chan string   // receives the key of canceled Slow calls
+}
+
+func (n *Node) Name(key string) (string, error) {
+	return n.name, nil
+}
+
+func (n *Node) Slow(ctx context.Context, key string) (string, error) {
+	select {
+	case <-time.After(n.delay):
+		return n.name, nil
+	case <-ctx.Done():
+		if n.canceled != nil {
+			n.canceled <- key
+		}
+		return "", ctx.Err()
+	}
+}
+
+type NodeProxy struct {
+	Name func(key string) (string, error)
+	Slow func(key string) (string, error)
+}
+
+// newNodes serves a Node on each of n local listeners
+func newNodes(t *testing.T, names ...string) []*connServer {
+	nodes := make([]*connServer, 0, len(names))
+	for _, name := range names {
+		s := server.NewServer()
+		if err := s.Register(&Node{name: name}); err != nil {
+			t.Fatalf("newNodes|Register|Fail|%v", err)
+		}
+		nodes = append(nodes, newConnServer(t, s))
+	}
+	return nodes
+}
+
+func addrs(nodes []*connServer) []string {
+	addresses := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addresses = append(addresses, node.addr())
+	}
+	return addresses
+}
+
+// test the built-in balancers route calls as expected
+func TestBalancedClient(t *testing.T) {
+	nodes := newNodes(t, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.l.Close()
+	}
+
+	cases := []struct {
+		name     string
+		balancer Balancer
+		check    func(seen map[string]int) bool
+	}{
+		{"RoundRobin", RoundRobinBalancer(), func(seen map[string]int) bool {
+			return seen["a"] == 3 && seen["b"] == 3 && seen["c"] == 3
+		}},
+		{"Random", RandomBalancer(), func(seen map[string]int) bool {
+			return seen["a"]+seen["b"]+seen["c"] == 9
+		}},
+		{"LeastPending", LeastPendingBalancer(), func(seen map[string]int) bool {
+			return seen["a"]+seen["b"]+seen["c"] == 9
+		}},
+		{"Hash", HashBalancer(nil), func(seen map[string]int) bool {
+			return len(seen) == 1
+		}},
+	}
+	for _, c := range cases {
+		b := NewBalancedClient("tcp", addrs(nodes), "Node", new(NodeProxy), BalanceConfig{Balancer: c.balancer})
+		node := b.GetService().(*NodeProxy)
+		seen := make(map[string]int)
+		for i := 0; i < 9; i++ {
+			name, err := node.Name("same key")
+			if err != nil {
+				t.Fatalf("TestBalancedClient|%s|Name|Fail|%v", c.name, err)
+				return
+			}
+			seen[name]++
+		}
+		b.Close()
+		if !c.check(seen) {
+			t.Fatalf("TestBalancedClient|%s|routing|Fail|%v", c.name, seen)
+			return
+		}
+	}
+}
+
+// test failing endpoints are ejected
+func TestBalancedClient_Eject(t *testing.T) {
+	nodes := newNodes(t, "a", "b")
+	defer nodes[1].l.Close()
+
+	b := NewBalancedClient("tcp", addrs(nodes), "Node", new(NodeProxy), BalanceConfig{MaxFailures: 1})
+	defer b.Close()
+	node := b.GetService().(*NodeProxy)
+
+	// node a goes away
+	nodes[0].l.Close()
+	nodes[0].dropAll()
+
+	failures := 0
+	for i := 0; i < 10; i++ {
+		name, err := node.Name("key")
+		if err != nil {
+			failures++
+			continue
+		}
+		if name != "b" {
+			t.Fatalf("TestBalancedClient_Eject|Name|Fail|%s", name)
+			return
+		}
+	}
+	if failures > 1 {
+		t.Fatalf("TestBalancedClient_Eject|failures|%d", failures)
+		return
+	}
+	if eps := b.Endpoints(); !eps[0].Ejected() || eps[1].Ejected() {
+		t.Fatalf("TestBalancedClient_Eject|Ejected|Fail|%v|%v", eps[0].Ejected(), eps[1].Ejected())
+	}
+}
+
+// test a slow call is hedged on another endpoint and the loser is canceled
+func TestBalancedClient_Hedge(t *testing.T) {
+	canceled := make(chan string, 1)
+	nodes := make([]*connServer, 0, 2)
+	for _, n := range []*Node{{name: "slow", delay: 5 * time.Second, canceled: canceled}, {name: "fast"}} {
+		s := server.NewServer()
+		if err := s.RegisterName("Node", n); err != nil {
+			t.Fatalf("TestBalancedClient_Hedge|RegisterName|Fail|%v", err)
+			return
+		}
+		node := newConnServer(t, s)
+		defer node.l.Close()
+		nodes = append(nodes, node)
+	}
+
+	// the first call always goes to the slow node
+	slow := nodes[0].addr()
+	balancer := BalancerFunc(func(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+		for _, ep := range endpoints {
+			if ep.Address == slow {
+				return ep
+			}
+		}
+		return endpoints[0]
+	})
+	b := NewBalancedClient("tcp", addrs(nodes), "Node", new(NodeProxy), BalanceConfig{Balancer: balancer},
+		WithHedge("Slow", 20*time.Millisecond), WithIdempotent("Slow"))
+	defer b.Close()
+	node := b.GetService().(*NodeProxy)
+
+	// the slow node tells the client it handles cancel messages
+	if _, err := node.Name("warm"); err != nil {
+		t.Fatalf("TestBalancedClient_Hedge|Name|Fail|%v", err)
+		return
+	}
+	start := time.Now()
+	name, err := node.Slow("hedged")
+	if err != nil || name != "fast" {
+		t.Fatalf("TestBalancedClient_Hedge|Slow|Fail|%v|%s", err, name)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("TestBalancedClient_Hedge|Slow|too slow|%v", elapsed)
+		return
+	}
+	select {
+	case key := <-canceled:
+		if key != "hedged" {
+			t.Fatalf("TestBalancedClient_Hedge|canceled|Fail|%s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestBalancedClient_Hedge|loser not canceled")
+	}
+}
+
+// chanResolver resolves every service from a channel
+type chanResolver chan []string
+
+func (r chanResolver) Resolve(ctx context.Context, service string) (<-chan []string, error) {
+	return r, nil
+}
+
+// test the endpoints follow the resolved addresses
+func TestNewResolvedClient(t *testing.T) {
+	nodes := newNodes(t, "a", "b")
+	for _, node := range nodes {
+		defer node.l.Close()
+	}
+
+	updates := make(chanResolver, 1)
+	updates <- addrs(nodes[:1])
+	b, err := NewResolvedClient("tcp", updates, "Node", new(NodeProxy), BalanceConfig{})
+	if err != nil {
+		t.Fatalf("TestNewResolvedClient|NewResolvedClient|Fail|%v", err)
+		return
+	}
+	defer b.Close()
+	node := b.GetService().(*NodeProxy)
+
+	if name, err := node.Name("key"); err != nil || name != "a" {
+		t.Fatalf("TestNewResolvedClient|Name|Fail|%v|%s", err, name)
+		return
+	}
+
+	// node b replaces node a
+	updates <- addrs(nodes[1:])
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		eps := b.Endpoints()
+		if len(eps) == 1 && eps[0].Address == nodes[1].addr() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestNewResolvedClient|update|timeout")
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if name, err := node.Name("key"); err != nil || name != "b" {
+		t.Fatalf("TestNewResolvedClient|Name|Fail|%v|%s", err, name)
+	}
+}
+
+// test an endpoint removed between the pick and the call still serves it
+func TestBalancedClient_RetirePicked(t *testing.T) {
+	nodes := newNodes(t, "a", "b")
+	b := NewBalancedClient("tcp", addrs(nodes[:1]), "Node", new(NodeProxy), BalanceConfig{})
+	defer b.Close()
+
+	call := &CallInfo{ServiceName: "Node", MethodName: "Name", Args: []interface{}{"k"}}
+	ep, err := b.pick(call, nil)
+	if err != nil {
+		t.Fatalf("TestBalancedClient_RetirePicked|pick|Fail|%v", err)
+		return
+	}
+	b.SetAddresses(addrs(nodes[1:]))
+
+	replys, err := b.invokeEndpoint(context.Background(), ep, call.ServiceName, call.MethodName, call.Args)
+	if err != nil || string(replys[0]) != `"a"` {
+		t.Fatalf("TestBalancedClient_RetirePicked|invokeEndpoint|Fail|%v|%s", err, replys)
+		return
+	}
+	if c, _ := ep.current(); c != nil {
+		t.Fatalf("TestBalancedClient_RetirePicked|close|Fail|still connected")
+	}
+}
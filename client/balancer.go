@@ -0,0 +1,104 @@
+package client
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// CallInfo describes the call a Balancer routes
+type CallInfo struct {
+	ServiceName string
+	MethodName  string
+	Args        []interface{}
+}
+
+// Balancer picks the endpoint carrying a call,
+// endpoints holds the healthy endpoints and is never empty
+type Balancer interface {
+	Pick(endpoints []*Endpoint, call *CallInfo) *Endpoint
+}
+
+// BalancerFunc adapts a function to the Balancer interface
+type BalancerFunc func(endpoints []*Endpoint, call *CallInfo) *Endpoint
+
+func (f BalancerFunc) Pick(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+	return f(endpoints, call)
+}
+
+// RoundRobinBalancer returns a balancer picking the endpoints in turn
+func RoundRobinBalancer() Balancer {
+	var next uint64
+	return BalancerFunc(func(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+		n := atomic.AddUint64(&next, 1) - 1
+		return endpoints[n%uint64(len(endpoints))]
+	})
+}
+
+// RandomBalancer returns a balancer picking a random endpoint
+func RandomBalancer() Balancer {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(rand.Int63()))
+	return BalancerFunc(func(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+		mu.Lock()
+		defer mu.Unlock()
+		return endpoints[r.Intn(len(endpoints))]
+	})
+}
+
+// LeastPendingBalancer returns a balancer picking the endpoint
+// with the fewest outstanding calls
+func LeastPendingBalancer() Balancer {
+	var next uint64
+	return BalancerFunc(func(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+		// start at a rotating offset so ties don't always go to the first endpoint
+		start := atomic.AddUint64(&next, 1)
+		var picked *Endpoint
+		for i := range endpoints {
+			ep := endpoints[(start+uint64(i))%uint64(len(endpoints))]
+			if picked == nil || ep.Pending() < picked.Pending() {
+				picked = ep
+			}
+		}
+		return picked
+	})
+}
+
+// HashBalancer returns a balancer sending calls with the same arguments to
+// the same endpoint, as long as it's healthy. When endpoints come and go
+// only the calls hashed to them move (rendezvous hashing).
+// key extracts the hashed value from the call, nil hashes all the arguments.
+func HashBalancer(key func(call *CallInfo) []byte) Balancer {
+	if key == nil {
+		key = func(call *CallInfo) []byte {
+			data, _ := json.Marshal(call.Args)
+			return data
+		}
+	}
+	return BalancerFunc(func(endpoints []*Endpoint, call *CallInfo) *Endpoint {
+		k := key(call)
+		var picked *Endpoint
+		var best uint64
+		for _, ep := range endpoints {
+			h := fnv.New64a()
+			h.Write(k)
+			h.Write([]byte(ep.Address))
+			if score := mix64(h.Sum64()); picked == nil || score > best {
+				picked, best = ep, score
+			}
+		}
+		return picked
+	})
+}
+
+// mix64 spreads the bits of a fnv hash (splitmix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
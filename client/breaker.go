@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/sunlidea/ferry/message"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState represents the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     // a few trial calls decide whether to close
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig configures the circuit breakers of a client,
+// there is one breaker per endpoint and method
+type BreakerConfig struct {
+	FailureRate      float64       // failure rate opening the circuit, 0 means 0.5
+	MinRequests      int           // calls in the window before the rate counts, 0 means 10
+	Window           time.Duration // period the failure rate is measured over, 0 means 10s
+	CoolDown         time.Duration // how long the circuit stays open, 0 means 5s
+	HalfOpenRequests int           // successful trial calls closing the circuit, 0 means 1
+
+	// OnStateChange, if set, observes the transitions of every breaker
+	OnStateChange func(endpoint, method string, from, to BreakerState)
+}
+
+// WithCircuitBreaker guards the calls of every endpoint and method with a
+// circuit breaker. While a circuit is open, calls fail with ErrCircuitOpen
+// without reaching the server.
+func WithCircuitBreaker(config BreakerConfig) Option {
+	if config.FailureRate <= 0 {
+		config.FailureRate = 0.5
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = 5 * time.Second
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+	return func(o *options) {
+		o.breaker = &config
+	}
+}
+
+// breaker is the circuit breaker of an endpoint and method
+type breaker struct {
+	mutex    sync.Mutex
+	config   *BreakerConfig
+	endpoint string
+	method   string
+	state    BreakerState
+	start    time.Time // start of the window, or when the circuit opened
+	total    int       // calls in the window
+	failures int       // failed calls in the window
+	trials   int       // trial calls let through while half-open
+	passed   int       // successful trial calls
+}
+
+func newBreaker(config *BreakerConfig, endpoint, method string) *breaker {
+	return &breaker{
+		config:   config,
+		endpoint: endpoint,
+		method:   method,
+		start:    time.Now(),
+	}
+}
+
+// State returns the state of the breaker
+func (b *breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && time.Since(b.start) >= b.config.CoolDown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may go through
+func (b *breaker) allow() bool {
+	b.mutex.Lock()
+	from := b.state
+	allowed := false
+	now := time.Now()
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.start) >= b.config.Window {
+			b.reset(now)
+		}
+		b.total++
+		allowed = true
+	case BreakerOpen:
+		if now.Sub(b.start) >= b.config.CoolDown {
+			b.state = BreakerHalfOpen
+			b.trials = 1
+			b.passed = 0
+			allowed = true
+		}
+	case BreakerHalfOpen:
+		if b.trials < b.config.HalfOpenRequests {
+			b.trials++
+			allowed = true
+		}
+	}
+	to := b.state
+	b.mutex.Unlock()
+
+	b.notify(from, to)
+	return allowed
+}
+
+// record counts the outcome of a call let through by allow
+func (b *breaker) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		// the caller gave up, the call tells nothing about the endpoint
+		b.mutex.Lock()
+		switch b.state {
+		case BreakerClosed:
+			if b.total > 0 {
+				b.total--
+			}
+		case BreakerHalfOpen:
+			// another trial may go through
+			b.trials--
+		}
+		b.mutex.Unlock()
+		return
+	}
+	failed := isBreakerFailure(err)
+
+	b.mutex.Lock()
+	from := b.state
+	now := time.Now()
+	switch b.state {
+	case BreakerClosed:
+		if failed {
+			b.failures++
+		}
+		if b.total >= b.config.MinRequests &&
+			float64(b.failures)/float64(b.total) >= b.config.FailureRate {
+			b.state = BreakerOpen
+			b.start = now
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.state = BreakerOpen
+			b.start = now
+		} else if b.passed++; b.passed >= b.config.HalfOpenRequests {
+			b.state = BreakerClosed
+			b.reset(now)
+		}
+	}
+	to := b.state
+	b.mutex.Unlock()
+
+	b.notify(from, to)
+}
+
+// reset starts a new window, b.mutex must be held
+func (b *breaker) reset(now time.Time) {
+	b.start = now
+	b.total = 0
+	b.failures = 0
+}
+
+// notify reports a transition to the state handler
+func (b *breaker) notify(from, to BreakerState) {
+	if from != to && b.config.OnStateChange != nil {
+		b.config.OnStateChange(b.endpoint, b.method, from, to)
+	}
+}
+
+// isBreakerFailure reports whether err counts against the circuit,
+// errors returned by the methods themselves don't
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*message.Error); ok {
+		return e.Code == message.CodeServiceUnavailable || e.Code == message.CodeInternal
+	}
+	return true
+}
+
+// breakers holds the circuit breakers of an endpoint, by method.
+// BalancedClient and Pool keep them by address, so they survive
+// the Client of a reconnected endpoint.
+type breakers struct {
+	mutex    sync.Mutex
+	config   *BreakerConfig
+	endpoint string
+	methods  map[string]*breaker
+}
+
+func newBreakers(config *BreakerConfig, endpoint string) *breakers {
+	return &breakers{
+		config:   config,
+		endpoint: endpoint,
+		methods:  make(map[string]*breaker),
+	}
+}
+
+// get returns the breaker of a method, nil if bs is nil
+func (bs *breakers) get(serviceName, methodName string) *breaker {
+	if bs == nil {
+		return nil
+	}
+	method := serviceName + "." + methodName
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	b, ok := bs.methods[method]
+	if !ok {
+		b = newBreaker(bs.config, bs.endpoint, method)
+		bs.methods[method] = b
+	}
+	return b
+}
+
+// circuitOpen reports whether calls of the method fail fast
+func (bs *breakers) circuitOpen(serviceName, methodName string) bool {
+	b := bs.get(serviceName, methodName)
+	return b != nil && b.State() == BreakerOpen
+}
+
+// withBreakers makes the client use bs, set by BalancedClient and Pool
+func withBreakers(bs *breakers) Option {
+	return func(o *options) {
+		o.sharedBreakers = bs
+	}
+}
+
+// breakerFor returns the breaker of a method, nil without WithCircuitBreaker
+func (c *Client) breakerFor(serviceName, methodName string) *breaker {
+	return c.breakers.get(serviceName, methodName)
+}
+
+// BreakerState returns the state of the circuit breaker of a method,
+// BreakerClosed without WithCircuitBreaker
+func (c *Client) BreakerState(serviceName, methodName string) BreakerState {
+	if b := c.breakerFor(serviceName, methodName); b != nil {
+		return b.State()
+	}
+	return BreakerClosed
+}
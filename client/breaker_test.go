@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sunlidea/ferry/server"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// test the circuit opens on failures and closes after the cool down
+func TestCircuitBreaker(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestCircuitBreaker|Register|Fail|%v", err)
+		return
+	}
+
+	var mu sync.Mutex
+	var transitions []string
+	config := BreakerConfig{
+		FailureRate: 0.6,
+		MinRequests: 2,
+		CoolDown:    20 * time.Millisecond,
+		OnStateChange: func(endpoint, method string, from, to BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, method+" "+from.String()+" -> "+to.String())
+		},
+	}
+	cliConn, srvConn := net.Pipe()
+	go s.ServeConn(srvConn)
+	c := NewClient(cliConn, "Arith", new(ArithProxy), WithCircuitBreaker(config))
+	arith := c.GetService().(*ArithProxy)
+
+	if _, err := arith.Add(1, 2); err != nil {
+		t.Fatalf("TestCircuitBreaker|Add|Fail|%v", err)
+		return
+	}
+	// errors of the method don't count
+	for i := 0; i < 3; i++ {
+		if _, err := arith.Mul(0, 2); err == nil {
+			t.Fatalf("TestCircuitBreaker|Mul|no error")
+			return
+		}
+	}
+	if state := c.BreakerState("Arith", "Mul"); state != BreakerClosed {
+		t.Fatalf("TestCircuitBreaker|application errors|%s", state)
+		return
+	}
+
+	s.Unregister("Arith")
+	for i := 0; i < 2; i++ {
+		if _, err := arith.Add(1, 2); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("TestCircuitBreaker|unavailable|Fail|%v", err)
+			return
+		}
+	}
+	if _, err := arith.Add(1, 2); err != ErrCircuitOpen {
+		t.Fatalf("TestCircuitBreaker|open|Fail|%v", err)
+		return
+	}
+	// other methods have their own circuit
+	if _, err := arith.Mul(1, 2); err == ErrCircuitOpen {
+		t.Fatalf("TestCircuitBreaker|Mul|Fail|%v", err)
+		return
+	}
+
+	s.Register(new(Arith))
+	time.Sleep(config.CoolDown)
+	if sum, err := arith.Add(1, 2); err != nil || sum != 3 {
+		t.Fatalf("TestCircuitBreaker|half-open|Fail|%v", err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"Arith.Add closed -> open",
+		"Arith.Add open -> half-open",
+		"Arith.Add half-open -> closed",
+	}
+	if diff := cmp.Diff(want, transitions); diff != "" {
+		t.Fatalf("TestCircuitBreaker|transitions|Fail|%s", diff)
+	}
+}
+
+// test a canceled trial call leaves the circuit half-open
+func TestBreaker_CanceledTrial(t *testing.T) {
+	config := &BreakerConfig{FailureRate: 0.5, MinRequests: 1, Window: time.Minute, CoolDown: time.Millisecond, HalfOpenRequests: 1}
+	b := newBreaker(config, "a:1", "Arith.Add")
+	b.allow()
+	b.record(io.ErrUnexpectedEOF)
+	time.Sleep(2 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("TestBreaker_CanceledTrial|trial|Fail|refused")
+		return
+	}
+	b.record(context.Canceled)
+	if state := b.State(); state != BreakerHalfOpen {
+		t.Fatalf("TestBreaker_CanceledTrial|canceled|Fail|%s", state)
+		return
+	}
+	if !b.allow() {
+		t.Fatalf("TestBreaker_CanceledTrial|next trial|Fail|refused")
+	}
+}
+
+// test the breakers of an endpoint survive its reconnection
+func TestBalancedClient_Breakers(t *testing.T) {
+	nodes := newNodes(t, "a")
+	b := NewBalancedClient("tcp", addrs(nodes), "Missing", new(NodeProxy), BalanceConfig{},
+		WithCircuitBreaker(BreakerConfig{MinRequests: 1, CoolDown: time.Hour}))
+	defer b.Close()
+	proxy := b.GetService().(*NodeProxy)
+
+	if _, err := proxy.Name("k"); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("TestBalancedClient_Breakers|unavailable|Fail|%v", err)
+		return
+	}
+	// the next call gets a new Client
+	b.Endpoints()[0].close()
+	if _, err := proxy.Name("k"); err != ErrCircuitOpen {
+		t.Fatalf("TestBalancedClient_Breakers|reconnected|Fail|%v", err)
+	}
+}
@@ -2,10 +2,12 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/transport"
 	"io"
 	"log"
 	"net"
@@ -20,6 +22,7 @@ const (
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 var ErrShutdown = errors.New("connection is shut down")
+var ErrDisconnected = errors.New("connection is lost, reconnecting")
 
 // Client represents the RPC client
 type Client struct {
@@ -30,7 +33,12 @@ type Client struct {
 	shutdown    bool // server has told us to stop
 	definition  interface{}
 	serviceName string
-	conn        net.Conn
+	conn        net.Conn      // nil while reconnecting
+	done        chan struct{} // closed by Close
+	state       State         // state of the connection
+	canCancel   bool          // the server of conn handles cancel messages
+	breakers    *breakers     // circuit breakers of the endpoint, nil without WithCircuitBreaker
+	options
 }
 
 // Call represents a RPC call
@@ -41,18 +49,41 @@ type Call struct {
 	Replys      []json.RawMessage // The replys from the function
 	Error       error             // After completion, the error status.
 	Done        chan *Call        // Strobes when call is complete.
+	msg         []byte            // encoded request, sent again after reconnecting
+	sent        bool              // written to a connection, the server may have run it
+	idempotent  bool              // may be sent again after reconnecting even if sent
 }
 
 // Dail the remote service server
-func Dail(network, address, serivceName string, definition interface{}) (*Client, error) {
+func Dail(network, address, serivceName string, definition interface{}, opts ...Option) (*Client, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn, serivceName, definition), nil
+	dial := func() (net.Conn, error) {
+		return net.Dial(network, address)
+	}
+	opts = append([]Option{WithDialer(dial)}, opts...)
+	return NewClient(conn, serivceName, definition, opts...), nil
 }
 
-func NewClient(conn net.Conn, serivceName string, definition interface{}) *Client {
+// DialAddress connects to the service at address, such as localhost:1234,
+// unix:///run/ferry.sock or inproc://arith (see package transport)
+func DialAddress(address, serviceName string, definition interface{}, opts ...Option) (*Client, error) {
+	conn, err := transport.Dial(context.Background(), address)
+	if err != nil {
+		return nil, err
+	}
+	dial := func() (net.Conn, error) {
+		return transport.Dial(context.Background(), address)
+	}
+	opts = append([]Option{WithDialer(dial)}, opts...)
+	return NewClient(conn, serviceName, definition, opts...), nil
+}
+
+// NewClient creates a client calling the service on conn, the exported
+// func fields of definition are set to functions calling the remote methods
+func NewClient(conn net.Conn, serivceName string, definition interface{}, opts ...Option) *Client {
 
 	c := &Client{
 		mutex:       sync.Mutex{},
@@ -62,15 +93,69 @@ func NewClient(conn net.Conn, serivceName string, definition interface{}) *Clien
 		shutdown:    false,
 		serviceName: serivceName,
 		conn:        conn,
+		done:        make(chan struct{}),
+		state:       StateConnected,
+	}
+	c.options = newOptions(opts)
+	if c.breaker != nil {
+		c.breakers = c.sharedBreakers
+		if c.breakers == nil {
+			c.breakers = newBreakers(c.breaker, conn.RemoteAddr().String())
+		}
 	}
 
 	//build dynamic call
+	c.definition = buildProxy(definition, serivceName, c.invoke, &c.options)
+
+	// get ready to accept message from the remote server
+	go c.clientConn(conn)
+
+	return c
+}
+
+// GetService returns a instance which represents the remote service definition
+func (c *Client) GetService() interface{} {
+	return c.definition
+}
+
+// Close closes the connection, calls waiting for a response fail with ErrShutdown
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrShutdown
+	}
+	c.closing = true
+	close(c.done)
+	conn := c.conn
+	if conn == nil {
+		// reconnecting, nobody else will fail the queued calls
+		c.failPending(ErrShutdown)
+	}
+	c.mutex.Unlock()
+
+	c.setState(StateShutdown)
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// invokeFunc sends a RPC call and waits for its replys
+type invokeFunc func(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error)
+
+// buildProxy creates a new instance of the definition struct
+// with each func field calling the remote method through invoke.
+// A definition pointing to an interface gets the adapter registered for it.
+func buildProxy(definition interface{}, serviceName string, invoke invokeFunc, o *options) interface{} {
 	rtype := reflect.TypeOf(definition)
 	if rtype.Kind() == reflect.Ptr {
 		rtype = rtype.Elem()
 	}
+	if rtype.Kind() == reflect.Interface {
+		return buildStub(rtype, serviceName, invoke, o)
+	}
 	instance := reflect.New(rtype)
-	c.definition = instance.Interface()
 
 	//MakeFunc
 	elem := instance.Elem()
@@ -91,28 +176,48 @@ func NewClient(conn net.Conn, serivceName string, definition interface{}) *Clien
 			out = append(out, field.Type().Out(j))
 		}
 
-		name := rtype.Field(i).Name
+		name, methodInvoke, err := methodInvoker(rtype.Field(i), invoke, o)
+		if err != nil {
+			panic(fmt.Sprintf("field %s field %s %v", rtype.Name(), rtype.Field(i).Name, err))
+		}
 		fn := func(in []reflect.Value) (results []reflect.Value) {
-			return c.rpcInvoke(serivceName, name, in, out)
+			return rpcInvoke(methodInvoke, serviceName, name, in, out)
 		}
 
 		v := reflect.MakeFunc(field.Type(), fn)
 		field.Set(v)
 	}
-
-	// get ready to accept message from the remote server
-	go c.clientConn(conn)
-
-	return c
+	return instance.Interface()
 }
 
-// GetService returns a instance which represents the remote service definition
-func (c *Client) GetService() interface{} {
-	return c.definition
+// methodInvoker returns the remote name of the method of a proxy field
+// and the invoke applying its settings
+func methodInvoker(field reflect.StructField, invoke invokeFunc, o *options) (string, invokeFunc, error) {
+	m, err := methodOptions(field, o)
+	if err != nil {
+		return "", nil, err
+	}
+	name := field.Name
+	if m.name != "" {
+		name = m.name
+	}
+	methodInvoke := withConfig(invoke, m)
+	if m.timeout > 0 {
+		// the timeout applies to each attempt, a timed out attempt isn't retried
+		methodInvoke = withTimeout(methodInvoke, m.timeout)
+	}
+	if m.idempotent {
+		policy := o.retry
+		if m.retry != nil {
+			policy = *m.retry
+		}
+		methodInvoke = withRetry(methodInvoke, policy)
+	}
+	return name, methodInvoke, nil
 }
 
 // rpcInvoke executes a RPC call
-func (c *Client) rpcInvoke(serviceName string, methodName string, in []reflect.Value, out []reflect.Type) (results []reflect.Value) {
+func rpcInvoke(invoke invokeFunc, serviceName string, methodName string, in []reflect.Value, out []reflect.Type) (results []reflect.Value) {
 
 	// convert reflect.Value to Interface{}
 	args := make([]interface{}, 0, len(in))
@@ -120,20 +225,39 @@ func (c *Client) rpcInvoke(serviceName string, methodName string, in []reflect.V
 		args = append(args, arg.Interface())
 	}
 
+	replys, err := invoke(context.Background(), serviceName, methodName, args)
+	return decodeResults(replys, err, out)
+}
+
+// invoke sends the request of a RPC call and waits for its replys
+func (c *Client) invoke(ctx context.Context, serviceName string, methodName string, args []interface{}) (replys []json.RawMessage, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if b := c.breakerFor(serviceName, methodName); b != nil {
+		if !b.allow() {
+			return nil, ErrCircuitOpen
+		}
+		defer func() {
+			b.record(err)
+		}()
+	}
+
 	// register call
 	call := new(Call)
 	call.ServiceName = serviceName
 	call.MethodName = methodName
 	call.Args = args
-	//TODO reply
-	//call.Replys =
 	call.Done = make(chan *Call, 1)
 
 	// create sequence number of the call
 	c.mutex.Lock()
+	if c.shutdown || c.closing {
+		c.mutex.Unlock()
+		return nil, ErrShutdown
+	}
 	seq := c.seq
 	c.seq++
-	c.pending[seq] = call
 	c.mutex.Unlock()
 
 	// build request
@@ -147,42 +271,149 @@ func (c *Client) rpcInvoke(serviceName string, methodName string, in []reflect.V
 	reqBody, err := json.Marshal(request)
 	if err != nil {
 		log.Print("ferry.rpcInvoke: Marshal Fail: ", err.Error())
-		return nil
+		return nil, err
 	}
+	m := callConfig(ctx)
 	msg := message.Message{
 		Header: &message.Header{
 			Version:      0,
 			MessageType:  message.MsgTypeRequest,
-			CompressType: message.NoneCompress,
-			BodyLength:   uint32(len(reqBody)),
+			CompressType: m.compress,
 			//ReqID
 			SeqID: seq,
 		},
-		Data: reqBody,
 	}
+	if m.oneway {
+		msg.MessageType = message.MsgTypeOneway
+	}
+	if err = msg.SetBody(reqBody); err != nil {
+		log.Print("ferry.rpcInvoke: SetBody Fail: ", err.Error())
+		return nil, err
+	}
+	call.msg = msg.Encode()
+	call.idempotent = m.idempotent
 
-	//TODO handle error
-	_, err = c.conn.Write(msg.Encode())
-	if err != nil {
-		log.Print("ferry.rpcInvoke: Write Fail: ", err.Error())
-		return nil
+	if m.oneway {
+		// no response to wait for
+		return nil, c.send(call.msg)
+	}
+
+	c.mutex.Lock()
+	if c.shutdown || c.closing {
+		c.mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	conn := c.conn
+	if conn == nil && (c.reconnect == nil || c.reconnect.Policy == FailPending) {
+		c.mutex.Unlock()
+		return nil, ErrDisconnected
+	}
+	// a queued call is sent once reconnected
+	c.pending[seq] = call
+	call.sent = conn != nil
+	c.mutex.Unlock()
+
+	if conn != nil {
+		_, err = conn.Write(call.msg)
+		if err != nil {
+			log.Print("ferry.rpcInvoke: Write Fail: ", err.Error())
+			if c.reconnect == nil || c.reconnect.Policy == FailPending {
+				c.removeCall(seq)
+				return nil, err
+			}
+		}
 	}
 
 	// wait for the response
-	respCall := <-call.Done
+	select {
+	case respCall := <-call.Done:
+		return respCall.Replys, respCall.Error
+	case <-ctx.Done():
+		c.cancelCall(seq)
+		return nil, ctx.Err()
+	}
+}
 
-	// convert to reflect.Type
-	replys := make([]reflect.Value, 0, len(respCall.Replys))
-	for i, r := range respCall.Replys {
+// decodeResults converts the replys of a call to values of the out types,
+// the last one is the error of the call
+func decodeResults(replys []json.RawMessage, err error, out []reflect.Type) []reflect.Value {
+	results := make([]reflect.Value, 0, len(out))
+	for i := 0; i < len(out)-1; i++ {
 		inst := reflect.New(out[i])
-		err = json.Unmarshal(r, inst.Interface())
-		if err != nil {
-			log.Print("ferry.rpcInvoke: Replys  Unmarshal  Fail: ", i, err.Error())
+		if i < len(replys) {
+			uerr := json.Unmarshal(replys[i], inst.Interface())
+			if uerr != nil {
+				log.Print("ferry.rpcInvoke: Replys  Unmarshal  Fail: ", i, uerr.Error())
+				if err == nil {
+					err = uerr
+				}
+			}
 		}
-		replys = append(replys, inst.Elem())
+		results = append(results, inst.Elem())
 	}
+	return append(results, errorValue(out[len(out)-1], err))
+}
+
+// removeCall forgets a pending call which never reached the server
+func (c *Client) removeCall(seq uint64) {
+	c.mutex.Lock()
+	delete(c.pending, seq)
+	c.mutex.Unlock()
+}
 
-	return replys
+// send writes a message which doesn't expect a response
+func (c *Client) send(msg []byte) error {
+	c.mutex.Lock()
+	shutdown := c.shutdown || c.closing
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if shutdown {
+		return ErrShutdown
+	}
+	if conn == nil {
+		return ErrDisconnected
+	}
+	_, err := conn.Write(msg)
+	if err != nil {
+		log.Print("ferry.rpcInvoke: Write Fail: ", err.Error())
+	}
+	return err
+}
+
+// cancelCall forgets a pending call the caller gave up on
+// and asks the server to cancel it, best effort
+func (c *Client) cancelCall(seq uint64) {
+	c.mutex.Lock()
+	_, pending := c.pending[seq]
+	delete(c.pending, seq)
+	conn := c.conn
+	canCancel := c.canCancel
+	c.mutex.Unlock()
+
+	if !pending || conn == nil || !canCancel {
+		// older servers close the connection on cancel messages
+		return
+	}
+	msg := message.Message{
+		Header: &message.Header{
+			MessageType:  message.MsgTypeCancel,
+			CompressType: message.NoneCompress,
+			SeqID:        seq,
+		},
+	}
+	if _, err := conn.Write(msg.Encode()); err != nil {
+		log.Print("ferry.rpcInvoke: Cancel Fail: ", err.Error())
+	}
+}
+
+// errorValue converts err to the error type of a result
+func errorValue(typ reflect.Type, err error) reflect.Value {
+	v := reflect.New(typ).Elem()
+	if err != nil && reflect.TypeOf(err).AssignableTo(typ) {
+		v.Set(reflect.ValueOf(err))
+	}
+	return v
 }
 
 // clientConn reads the message from the conn
@@ -199,25 +430,72 @@ func (c *Client) clientConn(conn net.Conn) {
 			log.Print("ferry.clientConn: RecvMessage Fail: ", err.Error())
 			break
 		}
+		if msg.Extension&message.ExtCancel != 0 {
+			c.mutex.Lock()
+			if c.conn == conn {
+				c.canCancel = true
+			}
+			c.mutex.Unlock()
+		}
 
 		go c.handleResponse(msg)
 	}
 
 	c.mutex.Lock()
-	c.shutdown = true
-	closing := c.closing
+	if c.conn != conn {
+		// an old connection, already replaced
+		c.mutex.Unlock()
+		return
+	}
 	if err == io.EOF {
-		if closing {
-			err = ErrShutdown
+		err = io.ErrUnexpectedEOF
+	}
+	if c.closing {
+		err = ErrShutdown
+	}
+	if c.reconnect != nil && c.dial != nil && !c.closing {
+		c.conn = nil
+		if c.reconnect.Policy == FailPending {
+			c.failPending(err)
 		} else {
-			err = io.ErrUnexpectedEOF
+			c.failSent(err)
 		}
+		c.mutex.Unlock()
+
+		conn.Close()
+		c.setState(StateDisconnected)
+		go c.redial()
+		return
 	}
-	for _, call := range c.pending {
+	c.shutdown = true
+	closing := c.closing
+	c.failPending(err)
+	c.mutex.Unlock()
+
+	if !closing {
+		c.setState(StateShutdown)
+	}
+}
+
+// failPending completes all the pending calls with err, c.mutex must be held
+func (c *Client) failPending(err error) {
+	for seq, call := range c.pending {
 		call.Error = err
 		call.done()
+		delete(c.pending, seq)
+	}
+}
+
+// failSent completes the pending calls which may have reached the server
+// and can't be sent again with err, c.mutex must be held
+func (c *Client) failSent(err error) {
+	for seq, call := range c.pending {
+		if call.sent && !call.idempotent {
+			call.Error = err
+			call.done()
+			delete(c.pending, seq)
+		}
 	}
-	c.mutex.Unlock()
 }
 
 // handleResponse handles a RPC call response message
@@ -232,13 +510,21 @@ func (c *Client) handleResponse(msg *message.Message) {
 	if msg.MessageType != message.MsgTypeResponse {
 		//not response message
 		log.Print("ferry.clientConn: Invalid Message Type: ", msg.MessageType)
+		if call != nil {
+			call.Error = message.Errorf(message.CodeInternal, "ferry.clientConn: invalid message type %d", msg.MessageType)
+			call.done()
+		}
 		return
 	}
 
 	// get response body
 	resp, err := msg.DecodeResponse()
 	if err != nil {
-		log.Print("ferry.clientConn: DecodeRequest: ", err.Error())
+		log.Print("ferry.clientConn: DecodeResponse: ", err.Error())
+		if call != nil {
+			call.Error = message.Errorf(message.CodeInternal, "ferry.clientConn: DecodeResponse: %v", err)
+			call.done()
+		}
 		return
 	}
 
@@ -246,7 +532,8 @@ func (c *Client) handleResponse(msg *message.Message) {
 	case call == nil:
 		//TODO
 	case resp.Error != "":
-		//TODO
+		call.Replys = resp.Result
+		call.Error = &message.Error{Code: resp.ErrCode, Message: resp.Error}
 		call.done()
 	default:
 		call.Replys = resp.Result
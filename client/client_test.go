@@ -1,12 +1,17 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/server"
+	"net"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 )
 
 type ArithProxy struct {
@@ -101,3 +106,203 @@ func TestClient_handleResponse(t *testing.T) {
 		return
 	}
 }
+
+type Arith int
+
+func (t *Arith) Add(A, B int) (int, error) {
+	return A + B, nil
+}
+
+func (t *Arith) Mul(A, B int) (int, error) {
+	if A == 0 || B == 0 {
+		return 0, errors.New("zero operand")
+	}
+	return A * B, nil
+}
+
+// newPipeClient serves s on one end of a pipe and returns a client on the other
+func newPipeClient(s *server.Server, serviceName string, definition interface{}) *Client {
+	cliConn, srvConn := net.Pipe()
+	go s.ServeConn(srvConn)
+	return NewClient(cliConn, serviceName, definition)
+}
+
+// test errors reported by the server reach the caller
+func TestClient_Errors(t *testing.T) {
+	s := server.NewServer()
+	err := s.Register(new(Arith))
+	if err != nil {
+		t.Fatalf("TestClient_Errors|Register|Fail|%v", err)
+		return
+	}
+
+	arith := newPipeClient(s, "Arith", new(ArithProxy)).GetService().(*ArithProxy)
+	sum, err := arith.Add(1, 2)
+	if err != nil || sum != 3 {
+		t.Fatalf("TestClient_Errors|Add|Fail|%v|%d", err, sum)
+		return
+	}
+	_, err = arith.Mul(0, 2)
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeApplication || e.Message != "zero operand" {
+		t.Fatalf("TestClient_Errors|Mul|Fail|%v", err)
+		return
+	}
+
+	err = s.Unregister("Arith")
+	if err != nil {
+		t.Fatalf("TestClient_Errors|Unregister|Fail|%v", err)
+		return
+	}
+	_, err = arith.Add(1, 2)
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeServiceUnavailable {
+		t.Fatalf("TestClient_Errors|removed service|Fail|%v", err)
+	}
+}
+
+type Pair struct {
+	A, B int
+}
+
+type Sum struct {
+	N int
+}
+
+func (t *Arith) AddPair(p *Pair) (*Sum, error) {
+	return &Sum{N: p.A + p.B}, nil
+}
+
+type PairProxy struct {
+	AddPair func(p *Pair) (*Sum, error)
+}
+
+// test the typed Invoke helper
+func TestInvoke(t *testing.T) {
+	s := server.NewServer()
+	err := server.Handle(s, "Typed", "AddPair", func(ctx context.Context, p *Pair) (*Sum, error) {
+		return &Sum{N: p.A + p.B}, nil
+	})
+	if err != nil {
+		t.Fatalf("TestInvoke|Handle|Fail|%v", err)
+		return
+	}
+
+	c := newPipeClient(s, "Typed", new(PairProxy))
+	sum, err := Invoke[Pair, Sum](context.Background(), c, "Typed.AddPair", &Pair{A: 1, B: 2})
+	if err != nil || sum.N != 3 {
+		t.Fatalf("TestInvoke|Invoke|Fail|%v|%+v", err, sum)
+		return
+	}
+
+	_, err = Invoke[Pair, Sum](context.Background(), c, "Typed.Missing", &Pair{})
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeMethodNotFound {
+		t.Fatalf("TestInvoke|Invoke|Fail|%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Invoke[Pair, Sum](ctx, c, "Typed.AddPair", &Pair{})
+	if err != context.Canceled {
+		t.Fatalf("TestInvoke|canceled|Fail|%v", err)
+	}
+}
+
+// Benchmark calls through the reflective proxy and dispatch
+func BenchmarkClient_Proxy(b *testing.B) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		b.Fatal(err)
+	}
+	proxy := newPipeClient(s, "Arith", new(PairProxy)).GetService().(*PairProxy)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := proxy.AddPair(&Pair{A: 1, B: 2}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark calls through Invoke and a typed handler
+func BenchmarkClient_Invoke(b *testing.B) {
+	s := server.NewServer()
+	arith := new(Arith)
+	err := server.Handle(s, "Arith", "AddPair", func(ctx context.Context, p *Pair) (*Sum, error) {
+		return arith.AddPair(p)
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := newPipeClient(s, "Arith", new(PairProxy))
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Invoke[Pair, Sum](ctx, c, "Arith.AddPair", &Pair{A: 1, B: 2}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Test clients dialing the address of a transport
+func TestDialAddress(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestDialAddress|Register|Fail|%v", err)
+		return
+	}
+	go s.ListenAndServe("inproc://client-test")
+
+	// the server may not be listening yet
+	var c *Client
+	var err error
+	for i := 0; i < 100; i++ {
+		if c, err = DialAddress("inproc://client-test", "Arith", new(ArithProxy)); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("TestDialAddress|DialAddress|Fail|%v", err)
+		return
+	}
+	defer c.Close()
+	sum, err := c.GetService().(*ArithProxy).Add(3, 4)
+	if err != nil || sum != 7 {
+		t.Fatalf("TestDialAddress|Add|Fail|%v|%d", err, sum)
+	}
+}
+
+// test a response that can't be decoded completes its call with an error
+func TestClient_UndecodableResponse(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	c := NewClient(cliConn, "Arith", new(ArithProxy))
+	defer c.Close()
+
+	call := &Call{ServiceName: "Arith", MethodName: "Add", Done: make(chan *Call, 1)}
+	c.mutex.Lock()
+	c.pending[9] = call
+	c.mutex.Unlock()
+
+	// a gzip body decompressing past the cap
+	msg := &message.Message{Header: &message.Header{
+		MessageType:  message.MsgTypeResponse,
+		CompressType: message.GzipCompress,
+		SeqID:        9,
+	}}
+	if err := msg.SetBody(make([]byte, message.MaxBodySize+1)); err != nil {
+		t.Fatalf("TestClient_UndecodableResponse|SetBody|Fail|%v", err)
+		return
+	}
+	c.handleResponse(msg)
+
+	select {
+	case done := <-call.Done:
+		if e, ok := done.Error.(*message.Error); !ok || e.Code != message.CodeInternal {
+			t.Fatalf("TestClient_UndecodableResponse|Error|Fail|%v", done.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestClient_UndecodableResponse|call not completed")
+	}
+}
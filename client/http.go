@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/sunlidea/ferry/transport"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DialHTTP connects to the service of a server sharing the port of an HTTP
+// server (see Server.HandleHTTP): the connection to address is upgraded
+// with a request to path before NewClient
+func DialHTTP(address, path, serviceName string, definition interface{}, opts ...Option) (*Client, error) {
+	dial := func() (net.Conn, error) {
+		return dialHTTP(address, path)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithDialer(dial)}, opts...)
+	return NewClient(conn, serviceName, definition, opts...), nil
+}
+
+// dialHTTP connects to address and asks for an Upgrade: ferry on path
+func dialHTTP(address, path string) (net.Conn, error) {
+	conn, err := transport.Dial(context.Background(), address)
+	if err != nil {
+		return nil, err
+	}
+	host := address
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: ferry\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "ferry") {
+		conn.Close()
+		return nil, fmt.Errorf("ferry.DialHTTP: unexpected HTTP response %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads the bytes buffered after the HTTP response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"github.com/sunlidea/ferry/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test a client sharing the port of an HTTP server
+func TestDialHTTP(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestDialHTTP|Register|Fail|%v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ferry", server.ConnectHandler(s))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c, err := DialHTTP(addr, "/ferry", "Arith", new(ArithProxy))
+	if err != nil {
+		t.Fatalf("TestDialHTTP|DialHTTP|Fail|%v", err)
+		return
+	}
+	defer c.Close()
+	sum, err := c.GetService().(*ArithProxy).Add(3, 4)
+	if err != nil || sum != 7 {
+		t.Fatalf("TestDialHTTP|Add|Fail|%v|%d", err, sum)
+		return
+	}
+
+	if _, err := DialHTTP(addr, "/", "Arith", new(ArithProxy)); err == nil {
+		t.Fatalf("TestDialHTTP|not upgraded|Fail|no error")
+	}
+}
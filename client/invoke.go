@@ -0,0 +1,33 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Invoke calls method, given as "Service.Method", with the single argument
+// req and decodes the first reply into a *Resp. Unlike the proxy functions
+// built by NewClient it doesn't go through reflect.MakeFunc, and the call
+// gives up when ctx is done.
+func Invoke[Req, Resp any](ctx context.Context, c *Client, method string, req *Req) (*Resp, error) {
+	dot := strings.LastIndex(method, ".")
+	if dot <= 0 || dot == len(method)-1 {
+		return nil, fmt.Errorf("ferry.Invoke: method %q is not of the form Service.Method", method)
+	}
+
+	replys, err := c.invoke(ctx, method[:dot], method[dot+1:], []interface{}{req})
+	if err != nil {
+		return nil, err
+	}
+	if len(replys) == 0 {
+		return nil, fmt.Errorf("ferry.Invoke: %s returned no reply", method)
+	}
+
+	var resp *Resp
+	if err := json.Unmarshal(replys[0], &resp); err != nil {
+		return nil, fmt.Errorf("ferry.Invoke: Replys Unmarshal Fail: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sunlidea/ferry/message"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Option configures a Client, or the clients of a Pool or BalancedClient
+type Option func(*options)
+
+// options holds the settings made by Options
+type options struct {
+	dial           func() (net.Conn, error) // redials the server
+	reconnect      *Reconnect               // nil disables reconnection
+	onState        func(State)              // observes state changes
+	retry          RetryPolicy              // retry policy of idempotent methods
+	breaker        *BreakerConfig           // nil disables circuit breakers
+	sharedBreakers *breakers                // breakers outliving the client, see withBreakers
+	methods        map[string]*methodConfig // per method settings, by proxy field name
+}
+
+// methodConfig holds the settings of a proxy method
+type methodConfig struct {
+	name       string // method name on the server, "" means the field name
+	timeout    time.Duration
+	idempotent bool
+	oneway     bool // the call doesn't wait for a response
+	compress   message.CompressType
+	retry      *RetryPolicy  // overrides options.retry
+	hedge      time.Duration // delay before a duplicate call, 0 disables hedging
+	tag        string        // settings of WithTag
+}
+
+// newOptions applies opts to the default settings
+func newOptions(opts []Option) options {
+	o := options{
+		retry:   DefaultRetryPolicy,
+		methods: make(map[string]*methodConfig),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// method returns the settings of a method, creating them if needed
+func (o *options) method(name string) *methodConfig {
+	m, ok := o.methods[name]
+	if !ok {
+		m = &methodConfig{}
+		o.methods[name] = m
+	}
+	return m
+}
+
+// RetryPolicy describes how failed calls of idempotent methods are retried.
+// Transport errors, such as a lost connection, are always retryable,
+// errors reported by the server only if their code is listed.
+type RetryPolicy struct {
+	MaxAttempts int     // attempts including the first one, 1 disables retries
+	Backoff     Backoff // delays between the attempts
+	Codes       []uint  // retryable message.Error codes
+}
+
+// DefaultRetryPolicy is used by idempotent methods without a policy of their own
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff: Backoff{
+		Initial:    10 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+	},
+	Codes: []uint{message.CodeServiceUnavailable},
+}
+
+// WithRetryPolicy sets the retry policy of the idempotent methods
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = policy
+	}
+}
+
+// WithIdempotent marks methods, by proxy field name, as idempotent so that
+// their failed calls are retried. A field may also be marked with the tag
+// `ferry:"idempotent"`. Calls of other methods are never retried.
+func WithIdempotent(methods ...string) Option {
+	return func(o *options) {
+		for _, name := range methods {
+			o.method(name).idempotent = true
+		}
+	}
+}
+
+// WithMethodRetry marks the method idempotent and retries it with policy
+func WithMethodRetry(method string, policy RetryPolicy) Option {
+	return func(o *options) {
+		m := o.method(method)
+		m.idempotent = true
+		m.retry = &policy
+	}
+}
+
+// WithHedge enables hedged calls of a read-only method, by proxy field name,
+// as does the tag `ferry:"hedge=50ms"`. The method must be idempotent,
+// see WithIdempotent.
+// When a BalancedClient call hasn't answered after delay, a duplicate is sent
+// to another endpoint. The first successful response is used and the other
+// call is canceled. A good delay is the p95 latency of the method.
+func WithHedge(method string, delay time.Duration) Option {
+	return func(o *options) {
+		o.method(method).hedge = delay
+	}
+}
+
+// WithTag applies the settings of a ferry tag, such as "timeout=2s,idempotent",
+// to a method as if its proxy field had the tag. Methods of interfaces,
+// which can't be tagged, are set up this way.
+func WithTag(method, tag string) Option {
+	return func(o *options) {
+		o.method(method).tag = tag
+	}
+}
+
+// methodOptions returns the settings of a proxy field from its tag and o.
+// The tag lists comma separated settings, such as
+//
+//	`ferry:"name=Divide,timeout=2s,idempotent,oneway,compress=gzip,hedge=50ms"`
+//
+// settings made by Options take precedence.
+func methodOptions(field reflect.StructField, o *options) (methodConfig, error) {
+	var m methodConfig
+	if err := parseTag(field.Tag.Get("ferry"), &m); err != nil {
+		return m, err
+	}
+
+	if om, ok := o.methods[field.Name]; ok {
+		if err := parseTag(om.tag, &m); err != nil {
+			return m, err
+		}
+		m.idempotent = m.idempotent || om.idempotent
+		if om.retry != nil {
+			m.retry = om.retry
+		}
+		if om.hedge > 0 {
+			m.hedge = om.hedge
+		}
+	}
+	if m.hedge > 0 && !m.idempotent {
+		return m, fmt.Errorf("hedged method must be idempotent")
+	}
+	return m, nil
+}
+
+// parseTag applies the settings of a ferry tag to m
+func parseTag(tag string, m *methodConfig) error {
+	for _, setting := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		var err error
+		switch key {
+		case "":
+		case "name":
+			m.name = value
+		case "timeout":
+			m.timeout, err = time.ParseDuration(value)
+		case "hedge":
+			m.hedge, err = time.ParseDuration(value)
+		case "idempotent":
+			m.idempotent = true
+		case "oneway":
+			m.oneway = true
+		case "compress":
+			switch value {
+			case "", "none":
+				m.compress = message.NoneCompress
+			case "gzip":
+				m.compress = message.GzipCompress
+			default:
+				err = fmt.Errorf("unknown compression %q", value)
+			}
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("tag ferry: %v", err)
+		}
+	}
+	return nil
+}
+
+// configKey is the context key of the settings of a proxy call
+type configKey struct{}
+
+// withConfig wraps invoke to pass the settings of the method down to the Client
+func withConfig(invoke invokeFunc, m methodConfig) invokeFunc {
+	return func(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+		return invoke(context.WithValue(ctx, configKey{}, m), serviceName, methodName, args)
+	}
+}
+
+// callConfig returns the settings of the proxy call of ctx
+func callConfig(ctx context.Context) methodConfig {
+	m, _ := ctx.Value(configKey{}).(methodConfig)
+	return m
+}
+
+// withTimeout wraps invoke to fail calls not answered within timeout
+func withTimeout(invoke invokeFunc, timeout time.Duration) invokeFunc {
+	return func(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoke(ctx, serviceName, methodName, args)
+	}
+}
+
+// retryable reports whether the failed call may be tried again
+func (p *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || err == ErrCircuitOpen || err == ErrShutdown {
+		// the caller gave up, the server is known to be failing
+		// or the client is closed
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// the attempt timed out
+		return false
+	}
+	if isEncodeError(err) {
+		// the arguments can't be sent, another attempt won't help
+		return false
+	}
+	if e, ok := err.(*message.Error); ok {
+		for _, code := range p.Codes {
+			if e.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isEncodeError reports whether err comes from encoding the arguments
+func isEncodeError(err error) bool {
+	var typeErr *json.UnsupportedTypeError
+	var valueErr *json.UnsupportedValueError
+	var marshalerErr *json.MarshalerError
+	return errors.As(err, &typeErr) || errors.As(err, &valueErr) || errors.As(err, &marshalerErr)
+}
+
+// withRetry wraps invoke to retry failed calls according to policy
+func withRetry(invoke invokeFunc, policy RetryPolicy) invokeFunc {
+	return func(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+		for attempt := 1; ; attempt++ {
+			replys, err := invoke(ctx, serviceName, methodName, args)
+			if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(ctx, err) {
+				return replys, err
+			}
+			select {
+			case <-time.After(policy.Backoff.Delay(attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
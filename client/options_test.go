@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/server"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type FlakyProxy struct {
+	Get func(key string) (string, error) `ferry:"idempotent"`
+	Put func(key string) (string, error)
+}
+
+// flaky returns an invoke failing the first n calls of each method with err
+func flaky(n int, err error, calls map[string]int) invokeFunc {
+	return func(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+		calls[methodName]++
+		if calls[methodName] <= n {
+			return nil, err
+		}
+		reply, _ := json.Marshal(args[0])
+		return []json.RawMessage{reply, json.RawMessage("null")}, nil
+	}
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1},
+	Codes:       []uint{message.CodeServiceUnavailable},
+}
+
+// test only idempotent methods are retried
+func TestRetry(t *testing.T) {
+	calls := make(map[string]int)
+	o := newOptions([]Option{WithRetryPolicy(testRetryPolicy)})
+	proxy := buildProxy(new(FlakyProxy), "Flaky", flaky(2, io.ErrUnexpectedEOF, calls), &o).(*FlakyProxy)
+
+	if v, err := proxy.Get("k"); err != nil || v != "k" || calls["Get"] != 3 {
+		t.Fatalf("TestRetry|Get|Fail|%v|%s|%d", err, v, calls["Get"])
+		return
+	}
+	if _, err := proxy.Put("k"); err != io.ErrUnexpectedEOF || calls["Put"] != 1 {
+		t.Fatalf("TestRetry|Put|Fail|%v|%d", err, calls["Put"])
+		return
+	}
+
+	// marked by option
+	calls = make(map[string]int)
+	o = newOptions([]Option{WithMethodRetry("Put", testRetryPolicy)})
+	proxy = buildProxy(new(FlakyProxy), "Flaky", flaky(2, io.ErrUnexpectedEOF, calls), &o).(*FlakyProxy)
+	if v, err := proxy.Put("k"); err != nil || v != "k" || calls["Put"] != 3 {
+		t.Fatalf("TestRetry|WithMethodRetry|Fail|%v|%d", err, calls["Put"])
+		return
+	}
+
+	// out of attempts
+	calls = make(map[string]int)
+	o = newOptions([]Option{WithRetryPolicy(testRetryPolicy)})
+	proxy = buildProxy(new(FlakyProxy), "Flaky", flaky(5, ErrDisconnected, calls), &o).(*FlakyProxy)
+	if _, err := proxy.Get("k"); err != ErrDisconnected || calls["Get"] != 3 {
+		t.Fatalf("TestRetry|MaxAttempts|Fail|%v|%d", err, calls["Get"])
+		return
+	}
+
+	// only the listed codes are retried
+	for code, attempts := range map[uint]int{message.CodeServiceUnavailable: 3, message.CodeApplication: 1} {
+		calls = make(map[string]int)
+		proxy = buildProxy(new(FlakyProxy), "Flaky", flaky(5, &message.Error{Code: code}, calls), &o).(*FlakyProxy)
+		if _, err := proxy.Get("k"); err == nil || calls["Get"] != attempts {
+			t.Fatalf("TestRetry|code %d|Fail|%v|%d", code, err, calls["Get"])
+			return
+		}
+	}
+}
+
+type TaggedProxy struct {
+	Plus   func(A, B int) (int, error)    `ferry:"name=Add,compress=gzip"`
+	Times  func(A, B int) (int, error)    `ferry:"name=Mul"`
+	Echo   func(s string) (string, error) `ferry:"compress=gzip"`
+	Sleep  func(ms int) (int, error)      `ferry:"timeout=20ms"`
+	Notify func(n int) error              `ferry:"name=Record,oneway"`
+}
+
+// test the ferry tags of proxy fields
+func TestProxyTags(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestProxyTags|Register|Fail|%v", err)
+		return
+	}
+	s.RegisterFunc("Arith", "Echo", func(s string) (string, error) {
+		return s, nil
+	})
+	s.RegisterFunc("Arith", "Sleep", func(ctx context.Context, ms int) (int, error) {
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			return ms, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	})
+	recorded := make(chan int, 1)
+	s.RegisterFunc("Arith", "Record", func(n int) error {
+		recorded <- n
+		return nil
+	})
+
+	arith := newPipeClient(s, "Arith", new(TaggedProxy)).GetService().(*TaggedProxy)
+	if sum, err := arith.Plus(1, 2); err != nil || sum != 3 {
+		t.Fatalf("TestProxyTags|Plus|Fail|%v|%d", err, sum)
+		return
+	}
+	if product, err := arith.Times(2, 3); err != nil || product != 6 {
+		t.Fatalf("TestProxyTags|Times|Fail|%v|%d", err, product)
+		return
+	}
+	long := strings.Repeat("ferry ", 1000)
+	if echo, err := arith.Echo(long); err != nil || echo != long {
+		t.Fatalf("TestProxyTags|Echo|Fail|%v", err)
+		return
+	}
+
+	if ms, err := arith.Sleep(1); err != nil || ms != 1 {
+		t.Fatalf("TestProxyTags|Sleep|Fail|%v|%d", err, ms)
+		return
+	}
+	if _, err := arith.Sleep(1000); err != context.DeadlineExceeded {
+		t.Fatalf("TestProxyTags|Sleep|timeout|%v", err)
+		return
+	}
+
+	if err := arith.Notify(7); err != nil {
+		t.Fatalf("TestProxyTags|Notify|Fail|%v", err)
+		return
+	}
+	select {
+	case n := <-recorded:
+		if n != 7 {
+			t.Fatalf("TestProxyTags|Notify|recorded|%d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestProxyTags|Notify|not delivered")
+	}
+}
+
+// test invalid tags are rejected when the proxy is built
+func TestProxyTags_Invalid(t *testing.T) {
+	for _, definition := range []interface{}{
+		new(struct {
+			F func() error `ferry:"timeout=soon"`
+		}),
+		new(struct {
+			F func() error `ferry:"compress=zip"`
+		}),
+		new(struct {
+			F func() error `ferry:"retries=3"`
+		}),
+		new(struct {
+			F func() error `ferry:"hedge=10ms"`
+		}),
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("TestProxyTags_Invalid|%T|accepted", definition)
+				}
+			}()
+			o := newOptions(nil)
+			buildProxy(definition, "Bad", flaky(0, nil, map[string]int{}), &o)
+		}()
+	}
+}
+
+// Test the errors another attempt can't fix aren't retried
+func TestRetryPolicy_retryable(t *testing.T) {
+	_, encodeErr := json.Marshal(make(chan int))
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{message.Errorf(message.CodeServiceUnavailable, "busy"), true},
+		{message.Errorf(message.CodeApplication, "failed"), false},
+		{ErrShutdown, false},
+		{ErrCircuitOpen, false},
+		{context.DeadlineExceeded, false},
+		{context.Canceled, false},
+		{encodeErr, false},
+	}
+	for _, test := range tests {
+		if got := DefaultRetryPolicy.retryable(context.Background(), test.err); got != test.want {
+			t.Fatalf("TestRetryPolicy_retryable|%v|Fail|%v", test.err, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("all pooled connections reached their pending limit")
+
+// PoolStrategy decides which pooled connection carries a call
+type PoolStrategy int
+
+const (
+	// LeastPending picks the connection with the fewest calls in flight
+	LeastPending PoolStrategy = iota
+	// RoundRobin picks the connections in turn
+	RoundRobin
+)
+
+// PoolConfig configures a Pool
+type PoolConfig struct {
+	Size       int          // number of connections, at least 1
+	MaxPending int          // calls in flight per connection, 0 means no limit
+	Strategy   PoolStrategy // how calls are spread over the connections
+}
+
+// Pool spreads the calls of a service over several connections
+// to the same address, broken connections are replaced in the background
+type Pool struct {
+	mutex       sync.Mutex
+	conns       []*poolConn
+	next        int
+	closed      bool
+	done        chan struct{}
+	config      PoolConfig
+	dial        func() (net.Conn, error)
+	serviceName string
+	definition  interface{}
+	opts        []Option
+	options     options   // settings of the pool proxy
+	breakers    *breakers // circuit breakers of the address, shared by the slots
+}
+
+// poolConn is a slot of the pool
+type poolConn struct {
+	client  *Client // nil while being replaced
+	pending int     // calls in flight, protected by Pool.mutex
+}
+
+// NewPool dials config.Size connections to address and returns a pool whose
+// GetService instance is used the same way as the one of NewClient.
+// opts apply to every pooled Client, the state handler is used by the pool.
+func NewPool(network, address, serviceName string, definition interface{}, config PoolConfig, opts ...Option) (*Pool, error) {
+	if config.Size < 1 {
+		config.Size = 1
+	}
+	p := &Pool{
+		conns:       make([]*poolConn, 0, config.Size),
+		done:        make(chan struct{}),
+		config:      config,
+		serviceName: serviceName,
+		definition:  definition,
+		opts:        opts,
+		options:     newOptions(opts),
+		dial: func() (net.Conn, error) {
+			return net.Dial(network, address)
+		},
+	}
+	if p.options.breaker != nil {
+		p.breakers = newBreakers(p.options.breaker, address)
+	}
+
+	for i := 0; i < config.Size; i++ {
+		slot := &poolConn{}
+		conn, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		slot.client = p.newClient(slot, conn)
+		p.conns = append(p.conns, slot)
+	}
+
+	p.definition = buildProxy(definition, serviceName, p.invoke, &p.options)
+	return p, nil
+}
+
+// newClient creates the client of a slot
+func (p *Pool) newClient(slot *poolConn, conn net.Conn) *Client {
+	opts := append([]Option{WithDialer(p.dial)}, p.opts...)
+	opts = append(opts, withBreakers(p.breakers), WithStateHandler(func(state State) {
+		if state == StateShutdown {
+			go p.replace(slot)
+		}
+	}))
+	return NewClient(conn, p.serviceName, p.definition, opts...)
+}
+
+// replace dials a new connection for a slot whose client shut down
+func (p *Pool) replace(slot *poolConn) {
+	p.mutex.Lock()
+	if p.closed || slot.client == nil || slot.client.State() != StateShutdown {
+		p.mutex.Unlock()
+		return
+	}
+	slot.client = nil
+	p.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(DefaultBackoff.Delay(attempt)):
+		case <-p.done:
+			return
+		}
+
+		conn, err := p.dial()
+		if err != nil {
+			log.Print("ferry.Pool: Dial Fail: ", err.Error())
+			continue
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		slot.client = p.newClient(slot, conn)
+		p.mutex.Unlock()
+		return
+	}
+}
+
+// GetService returns a instance which represents the remote service definition
+func (p *Pool) GetService() interface{} {
+	return p.definition
+}
+
+// Close closes all the pooled connections
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrShutdown
+	}
+	p.closed = true
+	close(p.done)
+	clients := make([]*Client, 0, len(p.conns))
+	for _, slot := range p.conns {
+		if slot.client != nil {
+			clients = append(clients, slot.client)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	return nil
+}
+
+// pick chooses the slot for a call and counts the call as pending
+func (p *Pool) pick() (*poolConn, *Client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, nil, ErrShutdown
+	}
+
+	var picked *poolConn
+	available := false
+	for i := 0; i < len(p.conns); i++ {
+		slot := p.conns[(p.next+i)%len(p.conns)]
+		if slot.client == nil || slot.client.State() == StateShutdown {
+			continue
+		}
+		available = true
+		if p.config.MaxPending > 0 && slot.pending >= p.config.MaxPending {
+			continue
+		}
+		if picked == nil || (p.config.Strategy == LeastPending && slot.pending < picked.pending) {
+			picked = slot
+		}
+		if p.config.Strategy == RoundRobin {
+			break
+		}
+	}
+	p.next++
+
+	if picked == nil {
+		if available {
+			return nil, nil, ErrPoolExhausted
+		}
+		return nil, nil, ErrDisconnected
+	}
+	picked.pending++
+	return picked, picked.client, nil
+}
+
+// invoke sends a RPC call over one of the pooled connections
+func (p *Pool) invoke(ctx context.Context, serviceName string, methodName string, args []interface{}) ([]json.RawMessage, error) {
+	slot, c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		p.mutex.Lock()
+		slot.pending--
+		p.mutex.Unlock()
+	}()
+	return c.invoke(ctx, serviceName, methodName, args)
+}
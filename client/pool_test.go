@@ -0,0 +1,159 @@
+package client
+
+import (
+	"github.com/sunlidea/ferry/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Gate blocks its calls until released
+type Gate struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *Gate) Wait() (bool, error) {
+	g.started <- struct{}{}
+	<-g.release
+	return true, nil
+}
+
+type GateProxy struct {
+	Wait func() (bool, error)
+}
+
+// connServer serves s on a local listener and keeps the accepted conns
+type connServer struct {
+	mu    sync.Mutex
+	l     net.Listener
+	conns []net.Conn
+}
+
+func newConnServer(t testing.TB, s *server.Server) *connServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("newConnServer|Listen|Fail|%v", err)
+	}
+	cs := &connServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cs.mu.Lock()
+			cs.conns = append(cs.conns, conn)
+			cs.mu.Unlock()
+			go s.ServeConn(conn)
+		}
+	}()
+	return cs
+}
+
+func (cs *connServer) addr() string {
+	return cs.l.Addr().String()
+}
+
+// dropAll closes the accepted conns
+func (cs *connServer) dropAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, conn := range cs.conns {
+		conn.Close()
+	}
+	cs.conns = nil
+}
+
+func (cs *connServer) count() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.conns)
+}
+
+// test calls are spread over the pool and limited per connection
+func TestPool(t *testing.T) {
+	s := server.NewServer()
+	gate := &Gate{started: make(chan struct{}, 8), release: make(chan struct{})}
+	if err := s.Register(gate); err != nil {
+		t.Fatalf("TestPool|Register|Fail|%v", err)
+		return
+	}
+	cs := newConnServer(t, s)
+	defer cs.l.Close()
+
+	p, err := NewPool("tcp", cs.addr(), "Gate", new(GateProxy), PoolConfig{Size: 2, MaxPending: 1})
+	if err != nil {
+		t.Fatalf("TestPool|NewPool|Fail|%v", err)
+		return
+	}
+	defer p.Close()
+	proxy := p.GetService().(*GateProxy)
+
+	// one call on each connection
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := proxy.Wait(); err != nil || !ok {
+				t.Errorf("TestPool|Wait|Fail|%v", err)
+			}
+		}()
+		<-gate.started
+	}
+
+	if _, err := proxy.Wait(); err != ErrPoolExhausted {
+		t.Fatalf("TestPool|limit|Fail|%v", err)
+		return
+	}
+	close(gate.release)
+	wg.Wait()
+	if cs.count() != 2 {
+		t.Fatalf("TestPool|conns|Fail|%d", cs.count())
+	}
+}
+
+// test broken connections are replaced
+func TestPool_Replace(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestPool_Replace|Register|Fail|%v", err)
+		return
+	}
+	cs := newConnServer(t, s)
+	defer cs.l.Close()
+
+	p, err := NewPool("tcp", cs.addr(), "Arith", new(ArithProxy), PoolConfig{Size: 3, Strategy: RoundRobin})
+	if err != nil {
+		t.Fatalf("TestPool_Replace|NewPool|Fail|%v", err)
+		return
+	}
+	defer p.Close()
+	arith := p.GetService().(*ArithProxy)
+
+	for i := 0; i < 6; i++ {
+		if sum, err := arith.Add(i, 1); err != nil || sum != i+1 {
+			t.Fatalf("TestPool_Replace|Add|Fail|%v|%d", err, sum)
+			return
+		}
+	}
+
+	cs.dropAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for cs.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestPool_Replace|replace|timeout|%d", cs.count())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 6; i++ {
+		if sum, err := arith.Add(i, 2); err != nil || sum != i+2 {
+			t.Fatalf("TestPool_Replace|Add after replace|Fail|%v|%d", err, sum)
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// State represents the state of the connection of a Client
+type State int
+
+const (
+	StateConnected    State = iota // the connection is up
+	StateDisconnected              // the connection is lost, waiting to redial
+	StateConnecting                // redialing the server
+	StateShutdown                  // the client is closed or gave up reconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// PendingPolicy decides what happens to calls while the connection is lost
+type PendingPolicy int
+
+const (
+	// FailPending fails calls waiting for a response with the connection
+	// error, and new calls with ErrDisconnected until reconnected
+	FailPending PendingPolicy = iota
+	// QueuePending keeps the calls waiting and sends them once reconnected.
+	// Calls already written to the lost connection may have run on the
+	// server, they fail with the connection error unless their method is
+	// idempotent (see WithIdempotent)
+	QueuePending
+)
+
+// Backoff computes the delays between reconnect attempts
+type Backoff struct {
+	Initial    time.Duration // delay before the first attempt
+	Max        time.Duration // upper bound of the delay
+	Multiplier float64       // growth of the delay after each failed attempt
+	Jitter     float64       // randomly shortens the delay by up to this fraction
+}
+
+// DefaultBackoff is used when Reconnect.Backoff is the zero value
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        10 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns the delay before the attempt, counting from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d -= d * b.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// Reconnect configures how a Client redials a lost connection
+type Reconnect struct {
+	Backoff     Backoff
+	MaxAttempts int // give up after so many failed dials, 0 means never
+	Policy      PendingPolicy
+}
+
+// WithDialer sets the function used to redial the server,
+// Dail sets it to dial the same address again
+func WithDialer(dial func() (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dial = dial
+	}
+}
+
+// WithReconnect makes the client redial the server when the connection
+// is lost, the GetService instance keeps working across reconnects
+func WithReconnect(r Reconnect) Option {
+	return func(o *options) {
+		if r.Backoff == (Backoff{}) {
+			r.Backoff = DefaultBackoff
+		}
+		o.reconnect = &r
+	}
+}
+
+// WithStateHandler sets a function called on every state change of the connection
+func WithStateHandler(fn func(State)) Option {
+	return func(o *options) {
+		o.onState = fn
+	}
+}
+
+// State returns the state of the connection
+func (c *Client) State() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// setState records the state and reports it to the state handler,
+// a closed client stays shut down
+func (c *Client) setState(state State) {
+	c.mutex.Lock()
+	if c.closing && state != StateShutdown {
+		c.mutex.Unlock()
+		return
+	}
+	changed := c.state != state
+	c.state = state
+	c.mutex.Unlock()
+
+	if changed && c.onState != nil {
+		c.onState(state)
+	}
+}
+
+// redial dials the server with backoff until connected, closed, or out of attempts
+func (c *Client) redial() {
+	for attempt := 0; c.reconnect.MaxAttempts <= 0 || attempt < c.reconnect.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(c.reconnect.Backoff.Delay(attempt)):
+		case <-c.done:
+			return
+		}
+
+		c.setState(StateConnecting)
+		conn, err := c.dial()
+		if err != nil {
+			log.Print("ferry.redial: Dial Fail: ", err.Error())
+			c.setState(StateDisconnected)
+			continue
+		}
+
+		c.mutex.Lock()
+		if c.closing {
+			c.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		c.canCancel = false
+		// the queued calls are written once the lock is released
+		seqs := make([]uint64, 0, len(c.pending))
+		for seq := range c.pending {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		queued := make([]*Call, 0, len(seqs))
+		for _, seq := range seqs {
+			call := c.pending[seq]
+			call.sent = true
+			queued = append(queued, call)
+		}
+		c.mutex.Unlock()
+
+		// report the state before clientConn may report a new loss
+		c.setState(StateConnected)
+		go c.clientConn(conn)
+
+		// a failed write shows up in clientConn
+		for _, call := range queued {
+			if _, err := conn.Write(call.msg); err != nil {
+				log.Print("ferry.redial: Write Fail: ", err.Error())
+				break
+			}
+		}
+		return
+	}
+
+	// out of attempts
+	c.mutex.Lock()
+	c.shutdown = true
+	c.failPending(ErrShutdown)
+	c.mutex.Unlock()
+	c.setState(StateShutdown)
+}
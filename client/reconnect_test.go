@@ -0,0 +1,232 @@
+package client
+
+import (
+	"errors"
+	"github.com/sunlidea/ferry/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials s over pipes and keeps the server side of the last conn
+type pipeDialer struct {
+	mu      sync.Mutex
+	s       *server.Server
+	srvConn net.Conn
+	refuse  bool
+}
+
+func (d *pipeDialer) dial() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refuse {
+		return nil, errors.New("connection refused")
+	}
+	cliConn, srvConn := net.Pipe()
+	d.srvConn = srvConn
+	go d.s.ServeConn(srvConn)
+	return cliConn, nil
+}
+
+// drop closes the server side of the last conn
+func (d *pipeDialer) drop(refuse bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refuse = refuse
+	d.srvConn.Close()
+}
+
+func (d *pipeDialer) accept() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refuse = false
+}
+
+// waitState waits for the client to reach state
+func waitState(t *testing.T, states chan State, want State) {
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("waitState|timeout|%s", want)
+		}
+	}
+}
+
+func newReconnectClient(t *testing.T, policy PendingPolicy) (*Client, *pipeDialer, chan State) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("newReconnectClient|Register|Fail|%v", err)
+	}
+	d := &pipeDialer{s: s}
+	conn, _ := d.dial()
+	states := make(chan State, 16)
+	c := NewClient(conn, "Arith", new(ArithProxy),
+		WithDialer(d.dial),
+		WithReconnect(Reconnect{
+			Backoff: Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2},
+			Policy:  policy,
+		}),
+		WithStateHandler(func(state State) { states <- state }))
+	return c, d, states
+}
+
+// test the same proxy keeps working after the connection is lost
+func TestClient_Reconnect(t *testing.T) {
+	c, d, states := newReconnectClient(t, FailPending)
+	defer c.Close()
+	arith := c.GetService().(*ArithProxy)
+
+	if sum, err := arith.Add(1, 2); err != nil || sum != 3 {
+		t.Fatalf("TestClient_Reconnect|Add|Fail|%v|%d", err, sum)
+		return
+	}
+
+	d.drop(true)
+	waitState(t, states, StateDisconnected)
+	if _, err := arith.Add(1, 2); err != ErrDisconnected {
+		t.Fatalf("TestClient_Reconnect|disconnected|Fail|%v", err)
+		return
+	}
+
+	d.accept()
+	waitState(t, states, StateConnected)
+	if sum, err := arith.Add(2, 3); err != nil || sum != 5 {
+		t.Fatalf("TestClient_Reconnect|Add|Fail|%v|%d", err, sum)
+		return
+	}
+
+	c.Close()
+	waitState(t, states, StateShutdown)
+	if _, err := arith.Add(1, 2); err != ErrShutdown {
+		t.Fatalf("TestClient_Reconnect|closed|Fail|%v", err)
+	}
+}
+
+// test calls made while reconnecting are queued
+func TestClient_ReconnectQueue(t *testing.T) {
+	c, d, states := newReconnectClient(t, QueuePending)
+	defer c.Close()
+	arith := c.GetService().(*ArithProxy)
+
+	d.drop(true)
+	waitState(t, states, StateDisconnected)
+
+	type result struct {
+		sum int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sum, err := arith.Add(4, 5)
+		done <- result{sum, err}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("TestClient_ReconnectQueue|not queued|%+v", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d.accept()
+	r := <-done
+	if r.err != nil || r.sum != 9 {
+		t.Fatalf("TestClient_ReconnectQueue|Add|Fail|%+v", r)
+	}
+}
+
+// test the backoff grows up to its bound
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2, Jitter: 0.5}
+	for attempt, max := range []time.Duration{10, 20, 40, 50, 50} {
+		max *= time.Millisecond
+		d := b.Delay(attempt)
+		if d > max || d < max/2 {
+			t.Fatalf("TestBackoff_Delay|%d|%v", attempt, d)
+		}
+	}
+}
+
+type WaitProxy struct {
+	Once  func() (int, error) `ferry:"name=Wait"`
+	Again func() (int, error) `ferry:"name=Wait,idempotent"`
+}
+
+// test only idempotent calls already sent are sent again once reconnected
+func TestClient_ReconnectSent(t *testing.T) {
+	s := server.NewServer()
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	err := s.RegisterFunc("Slow", "Wait", func() (int, error) {
+		started <- struct{}{}
+		<-release
+		return 1, nil
+	})
+	if err != nil {
+		t.Fatalf("TestClient_ReconnectSent|RegisterFunc|Fail|%v", err)
+		return
+	}
+	d := &pipeDialer{s: s}
+	conn, _ := d.dial()
+	c := NewClient(conn, "Slow", new(WaitProxy),
+		WithDialer(d.dial),
+		WithReconnect(Reconnect{
+			Backoff: Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2},
+			Policy:  QueuePending,
+		}))
+	defer c.Close()
+	proxy := c.GetService().(*WaitProxy)
+
+	once := make(chan error, 1)
+	again := make(chan error, 1)
+	go func() {
+		_, err := proxy.Once()
+		once <- err
+	}()
+	go func() {
+		_, err := proxy.Again()
+		again <- err
+	}()
+	<-started
+	<-started
+
+	d.drop(false)
+	if err := <-once; err == nil {
+		t.Fatalf("TestClient_ReconnectSent|Once|Fail|sent again")
+		return
+	}
+	// the idempotent call runs again on the new connection
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestClient_ReconnectSent|Again|Fail|not sent again")
+		return
+	}
+	close(release)
+	if err := <-again; err != nil {
+		t.Fatalf("TestClient_ReconnectSent|Again|Fail|%v", err)
+		return
+	}
+	select {
+	case <-started:
+		t.Fatalf("TestClient_ReconnectSent|Once|Fail|ran twice")
+	default:
+	}
+}
+
+// test the state stays shut down when closed while redialing
+func TestClient_CloseWhileRedialing(t *testing.T) {
+	c, d, states := newReconnectClient(t, QueuePending)
+	d.drop(true)
+	waitState(t, states, StateDisconnected)
+	c.Close()
+	waitState(t, states, StateShutdown)
+	time.Sleep(30 * time.Millisecond)
+	if state := c.State(); state != StateShutdown {
+		t.Fatalf("TestClient_CloseWhileRedialing|State|Fail|%s", state)
+	}
+}
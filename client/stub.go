@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+var (
+	adaptersMu sync.RWMutex
+	adapters   = make(map[reflect.Type]func(stub *Stub) interface{})
+)
+
+// RegisterAdapter registers the adapter implementing the service interface T
+// on top of a Stub. Then a pointer to T, such as (*Arith)(nil), can be given
+// as definition to NewClient, NewPool and NewBalancedClient, and GetService
+// returns a T. Adapters are written by hand or generated by ferrygen.
+func RegisterAdapter[T any](adapter func(stub *Stub) T) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() != reflect.Interface {
+		panic(fmt.Sprintf("client.RegisterAdapter: %s is not an interface", typ))
+	}
+
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	adapters[typ] = func(stub *Stub) interface{} {
+		return adapter(stub)
+	}
+}
+
+// Stub calls the methods of a remote service for an interface adapter
+type Stub struct {
+	serviceName string
+	methods     map[string]*stubMethod // by Go method name
+}
+
+// stubMethod is a method of the service interface
+type stubMethod struct {
+	name   string // remote name of the method
+	invoke invokeFunc
+}
+
+// buildStub returns the adapter of the interface typ calling the remote
+// service through invoke. Options set by method name apply to the methods.
+func buildStub(typ reflect.Type, serviceName string, invoke invokeFunc, o *options) interface{} {
+	adaptersMu.RLock()
+	adapter, ok := adapters[typ]
+	adaptersMu.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("interface %s has no adapter, see RegisterAdapter", typ))
+	}
+
+	stub := &Stub{
+		serviceName: serviceName,
+		methods:     make(map[string]*stubMethod, typ.NumMethod()),
+	}
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		numOut := method.Type.NumOut()
+		if numOut < 1 || !method.Type.Out(numOut-1).Implements(typeOfError) {
+			panic(fmt.Sprintf("interface %s method %s last out param not implements error", typ, method.Name))
+		}
+		name, methodInvoke, err := methodInvoker(reflect.StructField{Name: method.Name}, invoke, o)
+		if err != nil {
+			panic(fmt.Sprintf("interface %s method %s %v", typ, method.Name, err))
+		}
+		stub.methods[method.Name] = &stubMethod{name: name, invoke: methodInvoke}
+	}
+	return adapter(stub)
+}
+
+// Call calls the remote method of the interface method named method with args,
+// and decodes its results into replys, which are pointers.
+// A leading context.Context of the interface method is given as ctx, not in args.
+func (s *Stub) Call(ctx context.Context, method string, args []interface{}, replys ...interface{}) error {
+	m, ok := s.methods[method]
+	if !ok {
+		return fmt.Errorf("client.Stub: unknown method %s", method)
+	}
+	raw, err := m.invoke(ctx, s.serviceName, m.name, args)
+	if err != nil {
+		return err
+	}
+	for i, reply := range replys {
+		if i >= len(raw) {
+			break
+		}
+		if err := json.Unmarshal(raw[i], reply); err != nil {
+			log.Print("ferry.Stub: Replys  Unmarshal  Fail: ", i, err.Error())
+			return err
+		}
+	}
+	return nil
+}
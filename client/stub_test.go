@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/server"
+	"testing"
+)
+
+// ArithService is shared by the server and the client
+type ArithService interface {
+	Add(A, B int) (int, error)
+	Mul(ctx context.Context, A, B int) (int, error)
+}
+
+// arithAdapter implements ArithService on a Stub
+type arithAdapter struct {
+	stub *Stub
+}
+
+func (a arithAdapter) Add(A, B int) (int, error) {
+	var r0 int
+	err := a.stub.Call(context.Background(), "Add", []interface{}{A, B}, &r0)
+	return r0, err
+}
+
+func (a arithAdapter) Mul(ctx context.Context, A, B int) (int, error) {
+	var r0 int
+	err := a.stub.Call(ctx, "Mul", []interface{}{A, B}, &r0)
+	return r0, err
+}
+
+// test interface definitions get their adapter
+func TestStub(t *testing.T) {
+	RegisterAdapter(func(stub *Stub) ArithService {
+		return arithAdapter{stub}
+	})
+
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestStub|Register|Fail|%v", err)
+		return
+	}
+
+	arith := newPipeClient(s, "Arith", (*ArithService)(nil)).GetService().(ArithService)
+	if sum, err := arith.Add(1, 2); err != nil || sum != 3 {
+		t.Fatalf("TestStub|Add|Fail|%v|%d", err, sum)
+		return
+	}
+	if product, err := arith.Mul(context.Background(), 2, 3); err != nil || product != 6 {
+		t.Fatalf("TestStub|Mul|Fail|%v|%d", err, product)
+		return
+	}
+	_, err := arith.Mul(context.Background(), 0, 3)
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeApplication {
+		t.Fatalf("TestStub|Mul|error|%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := arith.Mul(ctx, 2, 3); err != context.Canceled {
+		t.Fatalf("TestStub|Mul|canceled|%v", err)
+		return
+	}
+
+	// interfaces without adapter are rejected
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("TestStub|no adapter|accepted")
+		}
+	}()
+	newPipeClient(s, "Arith", (*interface{ Add(A, B int) (int, error) })(nil))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/transport"
+	"net"
+	"time"
+)
+
+// caller sends requests to a server, one connection per call
+type caller struct {
+	address  string
+	timeout  time.Duration
+	compress message.CompressType
+	dial     func() (net.Conn, error) // dials address if nil
+}
+
+// conn connects to the server
+func (c *caller) conn() (net.Conn, error) {
+	if c.dial != nil {
+		return c.dial()
+	}
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return transport.Dial(ctx, c.address)
+}
+
+// call sends req and returns the response of the server
+func (c *caller) call(req message.Request) (*message.RawResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	msg := message.Message{
+		Header: &message.Header{
+			MessageType:  message.MsgTypeRequest,
+			CompressType: c.compress,
+		},
+	}
+	if err := msg.SetBody(body); err != nil {
+		return nil, err
+	}
+
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := conn.Write(msg.Encode()); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := message.RecvMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.address, err)
+		}
+		if resp.MessageType != message.MsgTypeResponse || resp.SeqID != msg.SeqID {
+			continue
+		}
+		return resp.DecodeResponse()
+	}
+}
@@ -0,0 +1,196 @@
+// Command ferry calls the methods of ferry services from the command line,
+// taking the place of throwaway client programs when debugging.
+//
+// Usage:
+//
+//	ferry [flags] call address Service.Method [json-arg ...]
+//	ferry [flags] list address
+//	ferry [flags] describe address [Service ...]
+//
+// call sends each argument as the JSON value given and prints the response
+// as indented JSON, exiting with status 1 if the method failed. list and
+// describe query the reflection service, published by servers calling
+// Server.RegisterReflection. The address is host:port, or any address of
+// package transport such as unix:///run/ferry.sock.
+//
+//	ferry call localhost:1234 Arith.Add 3 4
+//	ferry call localhost:1235 Calc.Divide '{"a": 7, "b": 2}'
+//	ferry describe localhost:1235 Calc
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/schema"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout of the call, including the connection")
+	gzip     = flag.Bool("gzip", false, "compress the request with gzip")
+	jsonMode = flag.Bool("json", false, "describe: print the schema as JSON")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: ferry [flags] call address Service.Method [json-arg ...]
+       ferry [flags] list address
+       ferry [flags] describe address [Service ...]
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ferry: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	compress := message.NoneCompress
+	if *gzip {
+		compress = message.GzipCompress
+	}
+	c := &caller{address: args[1], timeout: *timeout, compress: compress}
+
+	var err error
+	switch args[0] {
+	case "call":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		var failed bool
+		failed, err = call(os.Stdout, c, args[2], args[3:])
+		if err == nil && failed {
+			os.Exit(1)
+		}
+	case "list":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = list(os.Stdout, c)
+	case "describe":
+		err = describe(os.Stdout, c, args[2:], *jsonMode)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+}
+
+// call calls method with the JSON arguments and prints the response,
+// failed reports whether the method returned an error
+func call(w io.Writer, c *caller, method string, jsonArgs []string) (failed bool, err error) {
+	dot := strings.LastIndex(method, ".")
+	if dot <= 0 || dot == len(method)-1 {
+		return false, fmt.Errorf("method %q is not of the form Service.Method", method)
+	}
+	args := make([]interface{}, 0, len(jsonArgs))
+	for i, arg := range jsonArgs {
+		if !json.Valid([]byte(arg)) {
+			return false, fmt.Errorf("argument %d is not valid JSON: %s", i, arg)
+		}
+		args = append(args, json.RawMessage(arg))
+	}
+
+	resp, err := c.call(message.Request{Path: method[:dot], Method: method[dot+1:], Args: args})
+	if err != nil {
+		return false, err
+	}
+	out, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "%s\n", out)
+	return resp.ErrCode != message.CodeOK, nil
+}
+
+// callReflection calls a method of the reflection service and decodes its reply
+func callReflection(c *caller, method string, reply interface{}, args ...interface{}) error {
+	resp, err := c.call(message.Request{Path: schema.ReflectionService, Method: method, Args: args})
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.ErrCode == message.CodeServiceUnavailable:
+		return fmt.Errorf("%s doesn't publish the reflection service, see Server.RegisterReflection", c.address)
+	case resp.ErrCode != message.CodeOK:
+		return fmt.Errorf("%s.%s: %s", schema.ReflectionService, method, resp.Error)
+	case len(resp.Result) == 0:
+		return fmt.Errorf("%s.%s returned no reply", schema.ReflectionService, method)
+	}
+	return json.Unmarshal(resp.Result[0], reply)
+}
+
+// list prints the services of the server
+func list(w io.Writer, c *caller) error {
+	var services []string
+	if err := callReflection(c, "List", &services); err != nil {
+		return err
+	}
+	for _, name := range services {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
+
+// describe prints the methods of the named services and the types they use
+func describe(w io.Writer, c *caller, services []string, asJSON bool) error {
+	var s schema.Schema
+	if err := callReflection(c, "Describe", &s, services); err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Fprintln(w, s.String())
+		return nil
+	}
+
+	for _, svc := range s.Services {
+		fmt.Fprintf(w, "service %s\n", svc.Name)
+		for _, m := range svc.Methods {
+			fmt.Fprintf(w, "\t%s(%s)", m.Name, strings.Join(m.Args, ", "))
+			switch len(m.Replys) {
+			case 0:
+			case 1:
+				fmt.Fprintf(w, " %s", m.Replys[0])
+			default:
+				fmt.Fprintf(w, " (%s)", strings.Join(m.Replys, ", "))
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+
+	names := make([]string, 0, len(s.Types))
+	for name := range s.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "type %s\n", name)
+		for _, f := range s.Types[name].Fields {
+			fmt.Fprintf(w, "\t%s %s", f.JSON, f.Type)
+			if f.Number != 0 {
+				fmt.Fprintf(w, " = %d", f.Number)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
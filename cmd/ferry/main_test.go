@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sunlidea/ferry/server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Args struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type Arith int
+
+func (t *Arith) Add(a, b int) (int, error) {
+	return a + b, nil
+}
+
+func (t *Arith) Divide(args *Args) (int, error) {
+	if args.B == 0 {
+		return 0, errors.New("divide by zero")
+	}
+	return args.A / args.B, nil
+}
+
+// newCaller returns a caller of a server serving Arith over pipes
+func newCaller(t *testing.T, reflection bool) *caller {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("newCaller|Register|Fail|%v", err)
+	}
+	if reflection {
+		if err := s.RegisterReflection(); err != nil {
+			t.Fatalf("newCaller|RegisterReflection|Fail|%v", err)
+		}
+	}
+	dial := func() (net.Conn, error) {
+		conn, srv := net.Pipe()
+		go s.ServeConn(srv)
+		return conn, nil
+	}
+	return &caller{address: "pipe", timeout: time.Second, dial: dial}
+}
+
+// Test calls with JSON arguments
+func TestCall(t *testing.T) {
+	c := newCaller(t, false)
+
+	var out bytes.Buffer
+	failed, err := call(&out, c, "Arith.Add", []string{"3", "4"})
+	if err != nil || failed {
+		t.Fatalf("TestCall|Add|Fail|%v|%v", err, failed)
+		return
+	}
+	want := "{\n  \"code\": 0,\n  \"error\": \"\",\n  \"result\": [\n    7,\n    null\n  ]\n}\n"
+	if out.String() != want {
+		t.Fatalf("TestCall|Add|Fail|%q", out.String())
+		return
+	}
+
+	out.Reset()
+	failed, err = call(&out, c, "Arith.Divide", []string{`{"a": 7, "b": 0}`})
+	if err != nil || !failed || !strings.Contains(out.String(), `"error": "divide by zero"`) {
+		t.Fatalf("TestCall|Divide|Fail|%v|%v|%s", err, failed, out.String())
+		return
+	}
+
+	if _, err = call(&out, c, "Arith.Add", []string{"{"}); err == nil {
+		t.Fatalf("TestCall|invalid JSON|Fail|no error")
+		return
+	}
+	if _, err = call(&out, c, "Add", nil); err == nil {
+		t.Fatalf("TestCall|method|Fail|no error")
+	}
+}
+
+// Test the list and describe subcommands
+func TestReflection(t *testing.T) {
+	c := newCaller(t, true)
+
+	var out bytes.Buffer
+	if err := list(&out, c); err != nil || out.String() != "Arith\n" {
+		t.Fatalf("TestReflection|list|Fail|%v|%q", err, out.String())
+		return
+	}
+
+	out.Reset()
+	if err := describe(&out, c, nil, false); err != nil {
+		t.Fatalf("TestReflection|describe|Fail|%v", err)
+		return
+	}
+	args := "github.com/sunlidea/ferry/cmd/ferry.Args"
+	want := "service Arith\n\tAdd(int, int) int\n\tDivide(" + args + ") int\n\ntype " + args + "\n\ta int\n\tb int\n\n"
+	if out.String() != want {
+		t.Fatalf("TestReflection|describe|Fail|%q", out.String())
+		return
+	}
+
+	err := list(&out, newCaller(t, false))
+	if err == nil || !strings.Contains(err.Error(), "doesn't publish the reflection service") {
+		t.Fatalf("TestReflection|unavailable|Fail|%v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Command ferrycompat compares two versions of the schema of a ferry API and
+// reports the changes breaking existing clients, so it can gate merges.
+//
+// Usage:
+//
+//	ferrycompat [-type Arith,...] [-v] old new
+//	ferrycompat [-type Arith,...] -dump source
+//
+// A source is a .ferry file, a .json schema written by -dump, the address
+// of a server publishing the reflection service (tcp://host:port,
+// unix:///path, see Server.RegisterReflection), or a directory holding a Go
+// package whose handler types or interfaces are described. -type selects
+// the types of Go packages.
+//
+// Breaking changes are removed services or methods, changed numbers of
+// arguments or replys, retyped arguments, replys or fields, removed fields
+// and renamed JSON keys. ferrycompat exits with status 1 if it finds any,
+// and 2 on errors. With -v it lists the compatible changes too.
+//
+// A typical check compares a schema kept in the repository with the code:
+//
+//	ferrycompat -dump ./handler > api.json
+//	ferrycompat api.json ./handler
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sunlidea/ferry/client"
+	"github.com/sunlidea/ferry/idl"
+	"github.com/sunlidea/ferry/schema"
+	"github.com/sunlidea/ferry/schema/gosrc"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma separated types of Go packages, all the servable ones if empty")
+	verbose   = flag.Bool("v", false, "list the compatible changes too")
+	dump      = flag.Bool("dump", false, "print the schema of a single source as JSON")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ferrycompat [flags] old new\n       ferrycompat [flags] -dump source\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ferrycompat: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+
+	if *dump {
+		if flag.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		s, err := load(flag.Arg(0), names)
+		if err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+		fmt.Println(s)
+		return
+	}
+
+	if flag.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	old, err := load(flag.Arg(0), names)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	cur, err := load(flag.Arg(1), names)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+
+	changes := schema.Compare(old, cur)
+	for _, c := range changes {
+		if c.Breaking || *verbose {
+			fmt.Println(c)
+		}
+	}
+	if schema.Breaking(changes) {
+		os.Exit(1)
+	}
+}
+
+// load returns the schema of source
+func load(source string, names []string) (*schema.Schema, error) {
+	switch {
+	case strings.HasSuffix(source, ".ferry"):
+		f, err := idl.ParseFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return schema.FromIDL(f), nil
+	case strings.HasSuffix(source, ".json"):
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		s := schema.New()
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		return s, nil
+	case strings.Contains(source, "://"):
+		return describe(source, names)
+	}
+
+	pkg, err := gosrc.LoadPackage(source)
+	if err != nil {
+		return nil, err
+	}
+	return gosrc.FromPackage(pkg, names...)
+}
+
+// describe fetches the schema of the named services from the reflection
+// service of the server at address
+func describe(address string, names []string) (*schema.Schema, error) {
+	c, err := client.DialAddress(address, schema.ReflectionService, new(schema.ReflectionProxy))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	s, err := c.GetService().(*schema.ReflectionProxy).Describe(names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", address, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/types"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// clientPath is the import path of the ferry client package
+const clientPath = "github.com/sunlidea/ferry/client"
+
+// generator writes the client code of services
+type generator struct {
+	source  string            // file the code is generated from, if any
+	pkgName string            // package of the generated file
+	pkgPath string            // import path of that package
+	iface   bool              // emit interfaces and adapters instead of proxy structs
+	imports map[string]string // import path to name of the packages used
+	buf     bytes.Buffer
+}
+
+func newGenerator(pkgName, pkgPath string, iface bool) *generator {
+	return &generator{
+		pkgName: pkgName,
+		pkgPath: pkgPath,
+		iface:   iface,
+		imports: make(map[string]string),
+	}
+}
+
+// qualify renders the package of a type, recording its import
+func (g *generator) qualify(pkg *types.Package) string {
+	if pkg.Path() == g.pkgPath {
+		return ""
+	}
+	g.imports[pkg.Path()] = pkg.Name()
+	return pkg.Name()
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// generate returns the formatted source of the client code of services
+func (g *generator) generate(services []*service) ([]byte, error) {
+	for _, s := range services {
+		if g.iface {
+			g.genInterface(s)
+		} else {
+			g.genProxy(s)
+		}
+	}
+	return g.format()
+}
+
+// format returns the formatted source of the code written so far
+func (g *generator) format() ([]byte, error) {
+	var out bytes.Buffer
+	if g.source != "" {
+		fmt.Fprintf(&out, "// Code generated by ferrygen from %s. DO NOT EDIT.\n\n", g.source)
+	} else {
+		out.WriteString("// Code generated by ferrygen. DO NOT EDIT.\n\n")
+	}
+	fmt.Fprintf(&out, "package %s\n\n", g.pkgName)
+	out.WriteString(g.importBlock())
+	out.Write(g.buf.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return out.Bytes(), fmt.Errorf("format generated code: %v", err)
+	}
+	return src, nil
+}
+
+// importBlock returns the import declaration of the recorded packages
+func (g *generator) importBlock() string {
+	if len(g.imports) == 0 {
+		return ""
+	}
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	b.WriteString("import (\n")
+	for _, path := range paths {
+		name := g.imports[path]
+		if name != path[strings.LastIndex(path, "/")+1:] {
+			fmt.Fprintf(&b, "\t%s %q\n", name, path)
+		} else {
+			fmt.Fprintf(&b, "\t%q\n", path)
+		}
+	}
+	b.WriteString(")\n\n")
+	return b.String()
+}
+
+// genProxy writes the proxy struct of s and its constructors
+func (g *generator) genProxy(s *service) {
+	g.imports[clientPath] = "client"
+	g.imports["net"] = "net"
+	proxy := s.Name + "Proxy"
+	g.printf("// %s is the client definition of the %s service\n", proxy, s.Name)
+	g.printf("type %s struct {\n", proxy)
+	for _, m := range s.Methods {
+		g.printf("\t%s func(%s) %s\n", m.Name, g.paramList(m, false), resultList(m))
+	}
+	g.printf("}\n\n")
+
+	g.printf("// New%sClient returns a client of the %s service over conn\n", s.Name, s.Name)
+	g.printf("func New%sClient(conn net.Conn, opts ...client.Option) (*%s, *client.Client) {\n", s.Name, proxy)
+	g.printf("\tc := client.NewClient(conn, %q, new(%s), opts...)\n", s.Name, proxy)
+	g.printf("\treturn c.GetService().(*%s), c\n}\n\n", proxy)
+
+	g.printf("// Dial%s connects to the %s service at address\n", s.Name, s.Name)
+	g.printf("func Dial%s(network, address string, opts ...client.Option) (*%s, *client.Client, error) {\n", s.Name, proxy)
+	g.printf("\tc, err := client.Dail(network, address, %q, new(%s), opts...)\n", s.Name, proxy)
+	g.printf("\tif err != nil {\n\t\treturn nil, nil, err\n\t}\n")
+	g.printf("\treturn c.GetService().(*%s), c, nil\n}\n\n", proxy)
+}
+
+// genInterface writes the interface of s, the adapter implementing it
+// on a client.Stub and its constructors
+func (g *generator) genInterface(s *service) {
+	g.imports[clientPath] = "client"
+	g.imports["context"] = "context"
+	g.imports["net"] = "net"
+	adapter := unexported(s.Name) + "Client"
+	if s.Doc != "" {
+		g.printDoc("", s.Doc)
+	} else {
+		g.printf("// %s is the %s service\n", s.Name, s.Name)
+	}
+	g.printf("type %s interface {\n", s.Name)
+	for _, m := range s.Methods {
+		g.printDoc("\t", m.Doc)
+		g.printf("\t%s(%s) %s\n", m.Name, g.paramList(m, true), resultList(m))
+	}
+	g.printf("}\n\n")
+
+	g.printf("// %s implements %s by calling the remote service\n", adapter, s.Name)
+	g.printf("type %s struct {\n\tstub *client.Stub\n}\n\n", adapter)
+	for _, m := range s.Methods {
+		g.printf("func (c %s) %s(%s) %s {\n", adapter, m.Name, g.paramList(m, true), resultList(m))
+		replys := make([]string, 0, len(m.Results))
+		for i, typ := range m.Results[:len(m.Results)-1] {
+			g.printf("\tvar r%d %s\n", i, typ)
+			replys = append(replys, fmt.Sprintf("&r%d", i))
+		}
+		ctx := "context.Background()"
+		if m.Context {
+			ctx = "ctx"
+		}
+		call := fmt.Sprintf("c.stub.Call(%s, %q, []interface{}{%s}", ctx, m.Name, strings.Join(g.argNames(m), ", "))
+		if len(replys) > 0 {
+			call += ", " + strings.Join(replys, ", ")
+		}
+		call += ")"
+		if len(replys) == 0 {
+			g.printf("\treturn %s\n}\n\n", call)
+			continue
+		}
+		g.printf("\terr := %s\n", call)
+		returns := make([]string, 0, len(m.Results))
+		for i := range replys {
+			returns = append(returns, fmt.Sprintf("r%d", i))
+		}
+		g.printf("\treturn %s, err\n}\n\n", strings.Join(returns, ", "))
+	}
+
+	g.printf("func init() {\n")
+	g.printf("\tclient.RegisterAdapter(func(stub *client.Stub) %s {\n\t\treturn %s{stub}\n\t})\n}\n\n", s.Name, adapter)
+
+	// settings of the methods are passed as options
+	opts := "opts"
+	var tagged []method
+	for _, m := range s.Methods {
+		if m.Tag != "" {
+			tagged = append(tagged, m)
+		}
+	}
+	if len(tagged) > 0 {
+		opts = unexported(s.Name) + "Options(opts)"
+		g.printf("// %sOptions prepends the settings of the methods to opts\n", unexported(s.Name))
+		g.printf("func %sOptions(opts []client.Option) []client.Option {\n", unexported(s.Name))
+		g.printf("\treturn append([]client.Option{\n")
+		for _, m := range tagged {
+			g.printf("\t\tclient.WithTag(%q, %q),\n", m.Name, m.Tag)
+		}
+		g.printf("\t}, opts...)\n}\n\n")
+	}
+
+	g.printf("// New%sClient returns a client of the %s service over conn\n", s.Name, s.Name)
+	g.printf("func New%sClient(conn net.Conn, opts ...client.Option) (%s, *client.Client) {\n", s.Name, s.Name)
+	g.printf("\tc := client.NewClient(conn, %q, (*%s)(nil), %s...)\n", s.Name, s.Name, opts)
+	g.printf("\treturn c.GetService().(%s), c\n}\n\n", s.Name)
+
+	g.printf("// Dial%s connects to the %s service at address\n", s.Name, s.Name)
+	g.printf("func Dial%s(network, address string, opts ...client.Option) (%s, *client.Client, error) {\n", s.Name, s.Name)
+	g.printf("\tc, err := client.Dail(network, address, %q, (*%s)(nil), %s...)\n", s.Name, s.Name, opts)
+	g.printf("\tif err != nil {\n\t\treturn nil, nil, err\n\t}\n")
+	g.printf("\treturn c.GetService().(%s), c, nil\n}\n\n", s.Name)
+}
+
+// printDoc writes doc as a comment
+func (g *generator) printDoc(indent, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		g.printf("%s// %s\n", indent, line)
+	}
+}
+
+// reserved matches the names used by the generated method bodies
+var reserved = regexp.MustCompile(`^(_|c|ctx|err|stub|r[0-9]+)$`)
+
+// argNames returns the names of the arguments of m in generated code,
+// renaming those that are unnamed or would shadow a generated or imported name
+func (g *generator) argNames(m method) []string {
+	imported := make(map[string]bool, len(g.imports))
+	for _, name := range g.imports {
+		imported[name] = true
+	}
+	keep := func(name string) bool {
+		return name != "" && !reserved.MatchString(name) && !imported[name]
+	}
+	used := make(map[string]bool, len(m.Params))
+	for _, p := range m.Params {
+		if keep(p.Name) {
+			used[p.Name] = true
+		}
+	}
+
+	names := make([]string, 0, len(m.Params))
+	for i, p := range m.Params {
+		if keep(p.Name) {
+			names = append(names, p.Name)
+			continue
+		}
+		name := fmt.Sprintf("arg%d", i)
+		for n := i + 1; used[name] || imported[name]; n++ {
+			name = fmt.Sprintf("arg%d", n)
+		}
+		used[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// paramList returns the parameter list of m, with its context if withContext
+func (g *generator) paramList(m method, withContext bool) string {
+	params := make([]string, 0, len(m.Params)+1)
+	if withContext && m.Context {
+		params = append(params, "ctx context.Context")
+	}
+	for i, name := range g.argNames(m) {
+		params = append(params, name+" "+m.Params[i].Type)
+	}
+	return strings.Join(params, ", ")
+}
+
+// resultList returns the result list of m
+func resultList(m method) string {
+	if len(m.Results) == 1 {
+		return m.Results[0]
+	}
+	return "(" + strings.Join(m.Results, ", ") + ")"
+}
+
+// unexported returns name with its first letter in lower case
+func unexported(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/sunlidea/ferry/idl"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+const handlerSource = `package shop
+
+import "context"
+
+type Item struct {
+	Name  string
+	Price int
+}
+
+type Cart struct{}
+
+func (c *Cart) Add(item *Item, n int) (int, error) { return n, nil }
+
+func (c *Cart) Notify(ctx context.Context, err string) error { return nil }
+
+func (c *Cart) Items() ([]Item, map[string]int, error) { return nil, nil, nil }
+
+func (c *Cart) total() int { return 0 }
+
+type Feed struct{}
+
+func (f *Feed) Watch(ch chan int) error { return nil }
+`
+
+// checkSource type checks a package made of src
+func checkSource(t *testing.T, src string) *types.Package {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "shop.go", src, 0)
+	if err != nil {
+		t.Fatalf("checkSource|ParseFile|Fail|%v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("example.com/shop", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatalf("checkSource|Check|Fail|%v", err)
+	}
+	return pkg
+}
+
+// Test only the types the server accepts are found
+func TestFindServices(t *testing.T) {
+	pkg := checkSource(t, handlerSource)
+	g := newGenerator("shop", pkg.Path(), false)
+
+	services, err := findServices(pkg, nil, g.qualify)
+	if err != nil || len(services) != 1 || services[0].Name != "Cart" {
+		t.Fatalf("TestFindServices|all|Fail|%v|%+v", err, services)
+		return
+	}
+	if n := len(services[0].Methods); n != 3 {
+		t.Fatalf("TestFindServices|methods|Fail|%d", n)
+		return
+	}
+
+	_, err = findServices(pkg, []string{"Feed"}, g.qualify)
+	if err == nil || !strings.Contains(err.Error(), "Watch: argument 0: type chan int is not serializable") {
+		t.Fatalf("TestFindServices|Feed|Fail|%v", err)
+		return
+	}
+	if _, err = findServices(pkg, []string{"Missing"}, g.qualify); err == nil {
+		t.Fatalf("TestFindServices|Missing|found")
+	}
+}
+
+// Test the generated proxy structs and interfaces
+func TestGenerate(t *testing.T) {
+	pkg := checkSource(t, handlerSource)
+
+	cases := []struct {
+		name    string
+		pkgPath string
+		iface   bool
+		want    []string
+	}{
+		{"proxy", pkg.Path(), false, []string{
+			"type CartProxy struct {",
+			"Add    func(item *Item, n int) (int, error)",
+			"Items  func() ([]Item, map[string]int, error)",
+			"Notify func(arg0 string) error",
+			"func NewCartClient(conn net.Conn, opts ...client.Option) (*CartProxy, *client.Client) {",
+			"func DialCart(network, address string, opts ...client.Option) (*CartProxy, *client.Client, error) {",
+		}},
+		{"interface", "example.com/api", true, []string{
+			"type Cart interface {",
+			"Add(item *shop.Item, n int) (int, error)",
+			"Notify(ctx context.Context, arg0 string) error",
+			"var r1 map[string]int",
+			`err := c.stub.Call(context.Background(), "Items", []interface{}{}, &r0, &r1)`,
+			`return c.stub.Call(ctx, "Notify", []interface{}{arg0})`,
+			"client.RegisterAdapter(func(stub *client.Stub) Cart {",
+			`"example.com/shop"`,
+		}},
+	}
+	for _, c := range cases {
+		g := newGenerator("api", c.pkgPath, c.iface)
+		services, err := findServices(pkg, []string{"Cart"}, g.qualify)
+		if err != nil {
+			t.Fatalf("TestGenerate|%s|findServices|Fail|%v", c.name, err)
+			return
+		}
+		src, err := g.generate(services)
+		if err != nil {
+			t.Fatalf("TestGenerate|%s|generate|Fail|%v\n%s", c.name, err, src)
+			return
+		}
+		for _, want := range c.want {
+			if !strings.Contains(string(src), want) {
+				t.Fatalf("TestGenerate|%s|missing %q in\n%s", c.name, want, src)
+				return
+			}
+		}
+	}
+}
+
+// Test parameters named like imported packages or generated arguments are renamed
+func TestGenerate_ArgNames(t *testing.T) {
+	pkg := checkSource(t, `package shop
+
+import "time"
+
+type Clock struct{}
+
+func (c *Clock) Wait(context string, client int, time time.Duration) error { return nil }
+
+func (c *Clock) Pair(err int, arg0 string) error { return nil }
+`)
+	g := newGenerator("api", "example.com/api", true)
+	services, err := findServices(pkg, []string{"Clock"}, g.qualify)
+	if err != nil {
+		t.Fatalf("TestGenerate_ArgNames|findServices|Fail|%v", err)
+		return
+	}
+	src, err := g.generate(services)
+	if err != nil {
+		t.Fatalf("TestGenerate_ArgNames|generate|Fail|%v\n%s", err, src)
+		return
+	}
+	for _, want := range []string{
+		"Wait(arg0 string, arg1 int, arg2 time.Duration) error",
+		`return c.stub.Call(context.Background(), "Wait", []interface{}{arg0, arg1, arg2})`,
+		"Pair(arg1 int, arg0 string) error",
+		`return c.stub.Call(context.Background(), "Pair", []interface{}{arg1, arg0})`,
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("TestGenerate_ArgNames|missing %q in\n%s", want, src)
+			return
+		}
+	}
+}
+
+// Test the code generated from a .ferry file
+func TestGenerateIDL(t *testing.T) {
+	f, err := idl.Parse("shop.ferry", []byte(`
+message Item {
+	string name = 1;
+	repeated int64 sizes = 2;
+	map<string, Item> parts = 3;
+	bytes user_data = 4;
+}
+
+service Cart {
+	rpc Add(Item) returns (int64) [idempotent];
+	rpc Clear() returns ();
+}`))
+	if err != nil {
+		t.Fatalf("TestGenerateIDL|Parse|Fail|%v", err)
+		return
+	}
+	src, err := generateIDL(f, "shop")
+	if err != nil {
+		t.Fatalf("TestGenerateIDL|generateIDL|Fail|%v\n%s", err, src)
+		return
+	}
+	for _, want := range []string{
+		"// Code generated by ferrygen from shop.ferry. DO NOT EDIT.",
+		"Name     string           `json:\"name\" ferryfield:\"1\"`",
+		"Sizes    []int64          `json:\"sizes\" ferryfield:\"2\"`",
+		"Parts    map[string]*Item `json:\"parts\" ferryfield:\"3\"`",
+		"UserData []byte           `json:\"user_data\" ferryfield:\"4\"`",
+		"Add(ctx context.Context, req *Item) (int64, error)",
+		"Clear(ctx context.Context) error",
+		`client.WithTag("Add", "idempotent"),`,
+		"func RegisterCart(s *server.Server, impl Cart) error {",
+		`if err := s.RegisterFunc("Cart", "Clear", impl.Clear); err != nil {`,
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("TestGenerateIDL|missing %q in\n%s", want, src)
+			return
+		}
+	}
+}
+
+// Test files whose Go names wouldn't compile are refused before generating
+func TestGenerateIDL_Names(t *testing.T) {
+	for _, src := range []string{
+		"message Item { string user_id = 1; string userId = 2; }",
+		"message Item { string name = 1; } service Cart { rpc add(Item) returns (); }",
+		"message item { string name = 1; }",
+	} {
+		if f, err := idl.Parse("shop.ferry", []byte(src)); err == nil {
+			out, _ := generateIDL(f, "shop")
+			t.Fatalf("TestGenerateIDL_Names|%q|accepted|\n%s", src, out)
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sunlidea/ferry/idl"
+	"path/filepath"
+	"strings"
+)
+
+// serverPath is the import path of the ferry server package
+const serverPath = "github.com/sunlidea/ferry/server"
+
+// goTypes are the Go types of the scalars of .ferry files
+var goTypes = map[string]string{
+	"bool": "bool", "int32": "int32", "int64": "int64", "uint32": "uint32", "uint64": "uint64",
+	"float32": "float32", "float64": "float64", "string": "string", "bytes": "[]byte",
+}
+
+// generateIDL returns the Go code of a .ferry file: the message types, and for
+// each service an interface implemented by servers and clients, its
+// registration function, and the client adapter and constructors
+func generateIDL(f *idl.File, pkgName string) ([]byte, error) {
+	g := newGenerator(pkgName, "", true)
+	g.source = filepath.Base(f.Name)
+
+	for _, m := range f.Messages {
+		g.genMessage(m)
+	}
+
+	for _, s := range f.Services {
+		svc := &service{Name: s.Name, Doc: s.Doc}
+		for _, m := range s.Methods {
+			for _, setting := range m.Settings {
+				if strings.HasPrefix(setting, "name=") {
+					return nil, fmt.Errorf("%s: method %s.%s: the name setting is not supported", f.Name, s.Name, m.Name)
+				}
+			}
+			method := method{
+				Name:    m.Name,
+				Doc:     m.Doc,
+				Tag:     strings.Join(m.Settings, ","),
+				Context: true,
+			}
+			if m.Request != nil {
+				method.Params = []param{{Name: "req", Type: goType(m.Request)}}
+			}
+			if m.Response != nil {
+				method.Results = append(method.Results, goType(m.Response))
+			}
+			method.Results = append(method.Results, "error")
+			svc.Methods = append(svc.Methods, method)
+		}
+		g.genInterface(svc)
+		g.genRegister(svc)
+	}
+	return g.format()
+}
+
+// genMessage writes the struct of a message
+func (g *generator) genMessage(m *idl.Message) {
+	g.printDoc("", m.Doc)
+	g.printf("type %s struct {\n", m.Name)
+	for _, f := range m.Fields {
+		g.printDoc("\t", f.Doc)
+		g.printf("\t%s %s `json:\"%s\" ferryfield:\"%d\"`\n", idl.GoName(f.Name), goType(f.Type), f.Name, f.Number)
+	}
+	g.printf("}\n\n")
+}
+
+// genRegister writes the function registering an implementation of s
+func (g *generator) genRegister(s *service) {
+	g.imports[serverPath] = "server"
+	g.printf("// Register%s registers impl as the %s service of s\n", s.Name, s.Name)
+	g.printf("func Register%s(s *server.Server, impl %s) error {\n", s.Name, s.Name)
+	for _, m := range s.Methods {
+		g.printf("\tif err := s.RegisterFunc(%q, %q, impl.%s); err != nil {\n\t\treturn err\n\t}\n", s.Name, m.Name, m.Name)
+	}
+	g.printf("\treturn nil\n}\n\n")
+}
+
+// goType returns the Go type of t, messages are referred to by pointer
+func goType(t *idl.Type) string {
+	switch t.Kind {
+	case idl.Named:
+		return "*" + t.Name
+	case idl.Repeated:
+		return "[]" + goType(t.Elem)
+	case idl.Map:
+		return "map[" + goType(t.Key) + "]" + goType(t.Elem)
+	}
+	return goTypes[t.Name]
+}
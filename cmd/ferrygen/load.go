@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// service is a service whose client code is generated
+type service struct {
+	Name    string // service name, the handler type name
+	Doc     string
+	Methods []method
+}
+
+// method is a method of a service
+type method struct {
+	Name    string
+	Doc     string
+	Tag     string   // settings of the client proxy, as in ferry tags
+	Context bool     // the method takes a context.Context first
+	Params  []param  // arguments, without the context
+	Results []string // types of the replys, the last one is error
+}
+
+// param is an argument of a method
+type param struct {
+	Name string
+	Type string
+}
+
+// unsuitable lists the methods keeping a type from being registered
+type unsuitable struct {
+	Type    string
+	Reasons []string
+}
+
+func (e *unsuitable) Error() string {
+	return fmt.Sprintf("type %s has unsuitable methods:\n\t%s", e.Type, strings.Join(e.Reasons, "\n\t"))
+}
+
+// findServices returns the services of the named types of pkg, or of every
+// type suitable for Server.Register if names is empty.
+// Types are rendered with qualify.
+func findServices(pkg *types.Package, names []string, qualify types.Qualifier) ([]*service, error) {
+	if len(names) == 0 {
+		for _, name := range pkg.Scope().Names() {
+			obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+			if !ok || !obj.Exported() {
+				continue
+			}
+			if _, err := newService(obj, qualify); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+
+	services := make([]*service, 0, len(names))
+	for _, name := range names {
+		obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("type %s not found in %s", name, pkg.Path())
+		}
+		s, err := newService(obj, qualify)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// newService checks the methods of the type the way Server.Register does
+func newService(obj *types.TypeName, qualify types.Qualifier) (*service, error) {
+	if _, ok := obj.Type().Underlying().(*types.Interface); ok {
+		return nil, fmt.Errorf("type %s is an interface", obj.Name())
+	}
+	s := &service{Name: obj.Name()}
+	mset := types.NewMethodSet(types.NewPointer(obj.Type()))
+	var reasons []string
+	for i := 0; i < mset.Len(); i++ {
+		fn := mset.At(i).Obj().(*types.Func)
+		if !fn.Exported() {
+			continue
+		}
+		m, reason := newMethod(fn, qualify)
+		if reason != "" {
+			reasons = append(reasons, fn.Name()+": "+reason)
+			continue
+		}
+		s.Methods = append(s.Methods, m)
+	}
+	if len(reasons) > 0 {
+		return nil, &unsuitable{Type: obj.Name(), Reasons: reasons}
+	}
+	if len(s.Methods) == 0 {
+		return nil, fmt.Errorf("type %s has no exported methods", obj.Name())
+	}
+	sort.Slice(s.Methods, func(i, j int) bool { return s.Methods[i].Name < s.Methods[j].Name })
+	return s, nil
+}
+
+// newMethod describes fn, or reports why the server can't serve it
+func newMethod(fn *types.Func, qualify types.Qualifier) (method, string) {
+	m := method{Name: fn.Name()}
+	sig := fn.Type().(*types.Signature)
+	if sig.Variadic() {
+		return m, "variadic arguments are not supported"
+	}
+	results := sig.Results()
+	if results.Len() == 0 || !isError(results.At(results.Len()-1).Type()) {
+		return m, "last return type must be error"
+	}
+
+	params := sig.Params()
+	first := 0
+	if params.Len() > 0 && isContext(params.At(0).Type()) {
+		m.Context = true
+		first = 1
+	}
+	for i := first; i < params.Len(); i++ {
+		v := params.At(i)
+		if reason := checkType(v.Type(), nil); reason != "" {
+			return m, fmt.Sprintf("argument %d: %s", i-first, reason)
+		}
+		m.Params = append(m.Params, param{Name: v.Name(), Type: types.TypeString(v.Type(), qualify)})
+	}
+	for i := 0; i < results.Len(); i++ {
+		v := results.At(i)
+		if i < results.Len()-1 {
+			if reason := checkType(v.Type(), nil); reason != "" {
+				return m, fmt.Sprintf("reply %d: %s", i, reason)
+			}
+		}
+		m.Results = append(m.Results, types.TypeString(v.Type(), qualify))
+	}
+	return m, ""
+}
+
+func isError(t types.Type) bool {
+	return types.Implements(t, types.Universe.Lookup("error").Type().Underlying().(*types.Interface))
+}
+
+func isContext(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "context" && obj.Name() == "Context"
+}
+
+// checkType reports why values of t can't be carried by the JSON codec,
+// or "" if they can. It follows the rules of the server.
+func checkType(t types.Type, visited map[types.Type]bool) string {
+	if visited[t] {
+		// recursive type, already being checked
+		return ""
+	}
+	if visited == nil {
+		visited = make(map[types.Type]bool)
+	}
+	visited[t] = true
+
+	// types encoding themselves are trusted
+	if marshals(t, "MarshalJSON", "UnmarshalJSON") || marshals(t, "MarshalText", "UnmarshalText") {
+		return ""
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Invalid:
+			return "type can't be resolved, does the package compile?"
+		case types.Complex64, types.Complex128, types.UnsafePointer:
+			return fmt.Sprintf("type %s is not serializable", t)
+		}
+	case *types.Chan, *types.Signature:
+		return fmt.Sprintf("type %s is not serializable", t)
+	case *types.Interface:
+		if u.NumMethods() > 0 {
+			return fmt.Sprintf("interface type %s has no concrete type to decode into", t)
+		}
+	case *types.Pointer:
+		return checkType(u.Elem(), visited)
+	case *types.Slice:
+		return checkType(u.Elem(), visited)
+	case *types.Array:
+		return checkType(u.Elem(), visited)
+	case *types.Map:
+		key, ok := u.Key().Underlying().(*types.Basic)
+		if !ok || key.Info()&(types.IsString|types.IsInteger) == 0 {
+			if !marshals(u.Key(), "MarshalText", "UnmarshalText") {
+				return fmt.Sprintf("map key type %s is not serializable", u.Key())
+			}
+		}
+		return checkType(u.Elem(), visited)
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			f := u.Field(i)
+			if !f.Exported() && !f.Embedded() {
+				// unexported fields are ignored by the codec
+				continue
+			}
+			if reflect.StructTag(u.Tag(i)).Get("json") == "-" {
+				continue
+			}
+			if reason := checkType(f.Type(), visited); reason != "" {
+				return fmt.Sprintf("field %s.%s: %s", t, f.Name(), reason)
+			}
+		}
+	}
+	return ""
+}
+
+// marshals reports whether t (or a pointer to it) has both
+// the marshal method m and the unmarshal method u
+func marshals(t types.Type, m, u string) bool {
+	if _, ok := t.(*types.Pointer); !ok {
+		t = types.NewPointer(t)
+	}
+	mset := types.NewMethodSet(t)
+	return mset.Lookup(nil, m) != nil && mset.Lookup(nil, u) != nil
+}
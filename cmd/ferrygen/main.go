@@ -0,0 +1,153 @@
+// Command ferrygen generates the client code of the types of a package
+// suitable for Server.Register, so proxies don't drift from the handlers.
+//
+// Usage:
+//
+//	ferrygen [-type Arith,...] [-interface] [-o file] [-package name] [dir]
+//	ferrygen [-o file] [-package name] file.ferry
+//
+// For each type it writes a proxy struct, ArithProxy, with the constructors
+// NewArithClient and DialArith. With -interface it writes instead an
+// interface, Arith, with an adapter registered by client.RegisterAdapter.
+// It's usually run by go generate, from a comment in the handler package:
+//
+//	//go:generate ferrygen -type Arith -interface -o ../api/arith_ferry.go
+//
+// Given a .ferry file (see package idl), it writes the Go types of the
+// messages and, for each service, the interface implemented by the server
+// and the client, RegisterArith to serve an implementation, and the client
+// adapter and constructors. The output defaults to arith_ferry.go.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sunlidea/ferry/idl"
+	"github.com/sunlidea/ferry/schema/gosrc"
+	"go/build"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma separated handler types, all the suitable ones if empty")
+	iface     = flag.Bool("interface", false, "generate interfaces and adapters instead of proxy structs")
+	output    = flag.String("o", "", "output file, ferry_client.go in dir if empty")
+	pkgName   = flag.String("package", "", "package of the output file, guessed from its directory if empty")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ferrygen [flags] [dir]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ferrygen: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	dir := "."
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	} else if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	if strings.HasSuffix(dir, ".ferry") {
+		if *typeNames != "" || *iface {
+			log.Fatal("-type and -interface don't apply to .ferry files")
+		}
+		if err := runIDL(dir, *output, *pkgName); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	out := *output
+	if out == "" {
+		out = filepath.Join(dir, "ferry_client.go")
+	}
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+
+	if err := run(dir, names, out, *pkgName, *iface); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run generates the client code of the named types of the package in dir to out
+func run(dir string, names []string, out, name string, iface bool) error {
+	pkg, err := gosrc.LoadPackage(dir)
+	if err != nil {
+		return err
+	}
+
+	// the package of the output file
+	outDir := filepath.Dir(out)
+	rel, err := filepath.Rel(dir, outDir)
+	if err != nil {
+		return err
+	}
+	outPath := path.Join(pkg.Path(), filepath.ToSlash(rel))
+	if name == "" {
+		name = packageName(outDir)
+	}
+	if iface && outPath == pkg.Path() {
+		return fmt.Errorf("-interface: the interfaces would clash with the handler types, use -o to write them to another package")
+	}
+
+	g := newGenerator(name, outPath, iface)
+	services, err := findServices(pkg, names, g.qualify)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("no type of %s is suitable for Server.Register", pkg.Path())
+	}
+	src, err := g.generate(services)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, src, 0644)
+}
+
+// runIDL generates the Go code of the .ferry file at path to out
+func runIDL(path, out, name string) error {
+	f, err := idl.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = strings.TrimSuffix(path, ".ferry") + "_ferry.go"
+	}
+	if name == "" {
+		name = f.Package
+	}
+	if name == "" {
+		name = packageName(filepath.Dir(out))
+	}
+	src, err := generateIDL(f, name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, src, 0644)
+}
+
+// packageName returns the name of the Go package in dir,
+// or the name of dir if it has no Go files
+func packageName(dir string) string {
+	if bp, err := build.ImportDir(dir, 0); err == nil {
+		return bp.Name
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return filepath.Base(dir)
+	}
+	return filepath.Base(abs)
+}
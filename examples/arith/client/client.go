@@ -10,12 +10,12 @@ import (
 func main() {
 
 	c, err := client.Dail("tcp", "127.0.0.1"+":1234",
-		"Arith", new(api.ArithProxy))
+		"Arith", (*api.Arith)(nil))
 	if err != nil {
 		panic(err)
 	}
 
-	arithService := c.GetService().(*api.ArithProxy)
+	arithService := c.GetService().(api.Arith)
 	args := &api.Args{A: 10, B: 5}
 	mul, err := arithService.Multiply(args)
 	if err != nil {
@@ -1,3 +1,5 @@
+//go:generate ferrygen -type Arith -interface -o ../api/arith_ferry.go
+
 package handler
 
 import (
@@ -7,6 +9,8 @@ import (
 
 type Arith int
 
+var _ api.Arith = (*Arith)(nil)
+
 func (t *Arith) Multiply(args *api.Args) (int, error) {
 	return args.A * args.B, nil
 }
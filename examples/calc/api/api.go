@@ -0,0 +1,4 @@
+// Package api is the calc API, generated from calc.ferry
+package api
+
+//go:generate ferrygen calc.ferry
@@ -0,0 +1,82 @@
+// Code generated by ferrygen from calc.ferry. DO NOT EDIT.
+
+package api
+
+import (
+	"context"
+	"github.com/sunlidea/ferry/client"
+	"github.com/sunlidea/ferry/server"
+	"net"
+)
+
+// Operands of a division
+type Args struct {
+	A int64 `json:"a" ferryfield:"1"`
+	B int64 `json:"b" ferryfield:"2"`
+}
+
+type Quotient struct {
+	Quo int64 `json:"quo" ferryfield:"1"`
+	Rem int64 `json:"rem" ferryfield:"2"`
+}
+
+// Calc does arithmetic
+type Calc interface {
+	// Divide returns the quotient and remainder of a / b
+	Divide(ctx context.Context, req *Args) (*Quotient, error)
+	Reset(ctx context.Context) error
+}
+
+// calcClient implements Calc by calling the remote service
+type calcClient struct {
+	stub *client.Stub
+}
+
+func (c calcClient) Divide(ctx context.Context, req *Args) (*Quotient, error) {
+	var r0 *Quotient
+	err := c.stub.Call(ctx, "Divide", []interface{}{req}, &r0)
+	return r0, err
+}
+
+func (c calcClient) Reset(ctx context.Context) error {
+	return c.stub.Call(ctx, "Reset", []interface{}{})
+}
+
+func init() {
+	client.RegisterAdapter(func(stub *client.Stub) Calc {
+		return calcClient{stub}
+	})
+}
+
+// calcOptions prepends the settings of the methods to opts
+func calcOptions(opts []client.Option) []client.Option {
+	return append([]client.Option{
+		client.WithTag("Divide", "idempotent,timeout=2s"),
+	}, opts...)
+}
+
+// NewCalcClient returns a client of the Calc service over conn
+func NewCalcClient(conn net.Conn, opts ...client.Option) (Calc, *client.Client) {
+	c := client.NewClient(conn, "Calc", (*Calc)(nil), calcOptions(opts)...)
+	return c.GetService().(Calc), c
+}
+
+// DialCalc connects to the Calc service at address
+func DialCalc(network, address string, opts ...client.Option) (Calc, *client.Client, error) {
+	c, err := client.Dail(network, address, "Calc", (*Calc)(nil), calcOptions(opts)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.GetService().(Calc), c, nil
+}
+
+// RegisterCalc registers impl as the Calc service of s
+func RegisterCalc(s *server.Server, impl Calc) error {
+	if err := s.RegisterFunc("Calc", "Divide", impl.Divide); err != nil {
+		return err
+	}
+	if err := s.RegisterFunc("Calc", "Reset", impl.Reset); err != nil {
+		return err
+	}
+	return nil
+}
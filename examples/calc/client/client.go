@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sunlidea/ferry/examples/calc/api"
+	"log"
+)
+
+func main() {
+
+	calc, c, err := api.DialCalc("tcp", "127.0.0.1"+":1235")
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	args := &api.Args{A: 17, B: 5}
+	quo, err := calc.Divide(context.Background(), args)
+	if err != nil {
+		panic(fmt.Errorf("calc.Divide Fail|%v", err))
+	}
+	log.Printf("%d / %d = %d remainder %d\n", args.A, args.B, quo.Quo, quo.Rem)
+}
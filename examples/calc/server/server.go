@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/sunlidea/ferry/examples/calc/api"
+	"github.com/sunlidea/ferry/server"
+	"log"
+	"net"
+)
+
+// calc implements api.Calc
+type calc struct{}
+
+func (c *calc) Divide(ctx context.Context, args *api.Args) (*api.Quotient, error) {
+	if args.B == 0 {
+		return nil, errors.New("divide by zero")
+	}
+	return &api.Quotient{Quo: args.A / args.B, Rem: args.A % args.B}, nil
+}
+
+func (c *calc) Reset(ctx context.Context) error {
+	return nil
+}
+
+func main() {
+	s := server.NewServer()
+	err := api.RegisterCalc(s, new(calc))
+	if err != nil {
+		panic(err)
+	}
+	// lets ferrycompat compare the running server with calc.ferry
+	if err := s.RegisterReflection(); err != nil {
+		panic(err)
+	}
+
+	l, err := net.Listen("tcp", ":1235")
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("start the ferry server\n")
+	s.Serve(l)
+}
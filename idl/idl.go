@@ -0,0 +1,346 @@
+// Package idl parses .ferry files, which describe the messages and services
+// of a ferry API:
+//
+//	package arith;
+//
+//	// Args are the operands
+//	message Args {
+//		int64 a = 1;
+//		int64 b = 2;
+//		reserved 3;
+//	}
+//
+//	service Arith {
+//		rpc Multiply(Args) returns (int64);
+//		rpc Divide(Args) returns (Quotient) [idempotent, timeout=2s];
+//	}
+//
+// Field types are bool, int32, int64, uint32, uint64, float32, float64,
+// string, bytes, messages, repeated T and map<K, V>. Field numbers identify
+// the fields across versions, the field user_id is UserId in Go. Names of
+// messages, services and methods are used as is, so they must be exported
+// Go names. Methods take and return at most one value, and may list
+// settings of the client proxy in brackets.
+package idl
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// File is a parsed .ferry file
+type File struct {
+	Name     string // file name, used in errors
+	Package  string
+	Messages []*Message
+	Services []*Service
+}
+
+// Message is a struct of named and numbered fields
+type Message struct {
+	Name     string
+	Doc      string
+	Fields   []*Field
+	Reserved []int // field numbers no longer used
+	Pos      Pos
+}
+
+// Field is a field of a message
+type Field struct {
+	Name   string
+	Number int
+	Type   *Type
+	Doc    string
+	Pos    Pos
+}
+
+// Service is a set of methods
+type Service struct {
+	Name    string
+	Doc     string
+	Methods []*Method
+	Pos     Pos
+}
+
+// Method is a method of a service
+type Method struct {
+	Name     string
+	Doc      string
+	Request  *Type    // nil without argument
+	Response *Type    // nil without reply
+	Settings []string // settings of the client proxy, as in ferry tags
+	Pos      Pos
+}
+
+// Kind is the kind of a type
+type Kind int
+
+const (
+	Scalar   Kind = iota // a predeclared type, such as int64
+	Named                // a message
+	Repeated             // a list of Elem
+	Map                  // a map of Key to Elem
+)
+
+// Type is the type of a field, argument or reply
+type Type struct {
+	Kind Kind
+	Name string // name of the scalar or message
+	Key  *Type  // key type of a map
+	Elem *Type  // element type of a list or map
+}
+
+func (t *Type) String() string {
+	switch t.Kind {
+	case Repeated:
+		return "repeated " + t.Elem.String()
+	case Map:
+		return fmt.Sprintf("map<%s, %s>", t.Key, t.Elem)
+	}
+	return t.Name
+}
+
+// scalars are the predeclared types
+var scalars = map[string]bool{
+	"bool": true, "int32": true, "int64": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true, "string": true, "bytes": true,
+}
+
+// Pos is a position in a file
+type Pos struct {
+	Line, Column int
+}
+
+// Error is a syntax or semantic error of a file
+type Error struct {
+	File string
+	Pos  Pos
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Pos.Line, e.Pos.Column, e.Msg)
+}
+
+// ParseFile reads and parses the .ferry file at path
+func ParseFile(path string) (*File, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, src)
+}
+
+// Parse parses the .ferry source src, name is used in errors
+func Parse(name string, src []byte) (*File, error) {
+	p := &parser{lexer: lexer{name: name, src: string(src), line: 1, col: 1}}
+	p.next()
+	f, err := p.parseFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := check(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Message returns the message named name, or nil
+func (f *File) Message(name string) *Message {
+	for _, m := range f.Messages {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Service returns the service named name, or nil
+func (f *File) Service(name string) *Service {
+	for _, s := range f.Services {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Field returns the field numbered n, or nil
+func (m *Message) Field(n int) *Field {
+	for _, f := range m.Fields {
+		if f.Number == n {
+			return f
+		}
+	}
+	return nil
+}
+
+// Method returns the method named name, or nil
+func (s *Service) Method(name string) *Method {
+	for _, m := range s.Methods {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// check reports the first semantic error of f
+func check(f *File) error {
+	errorf := func(pos Pos, format string, args ...interface{}) error {
+		return &Error{File: f.Name, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	names := make(map[string]bool)
+	for _, m := range f.Messages {
+		if names[m.Name] || scalars[m.Name] {
+			return errorf(m.Pos, "%s redeclared", m.Name)
+		}
+		if !token.IsExported(m.Name) {
+			return errorf(m.Pos, "message %s: name must start with an upper case letter", m.Name)
+		}
+		names[m.Name] = true
+	}
+	for _, s := range f.Services {
+		if names[s.Name] {
+			return errorf(s.Pos, "%s redeclared", s.Name)
+		}
+		if !token.IsExported(s.Name) {
+			return errorf(s.Pos, "service %s: name must start with an upper case letter", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	var checkType func(pos Pos, t *Type) error
+	checkType = func(pos Pos, t *Type) error {
+		switch t.Kind {
+		case Named:
+			if f.Message(t.Name) == nil {
+				return errorf(pos, "undefined type %s", t.Name)
+			}
+		case Repeated:
+			return checkType(pos, t.Elem)
+		case Map:
+			if t.Key.Kind != Scalar || t.Key.Name == "bytes" || t.Key.Name == "bool" ||
+				strings.HasPrefix(t.Key.Name, "float") {
+				return errorf(pos, "invalid map key type %s", t.Key)
+			}
+			return checkType(pos, t.Elem)
+		}
+		return nil
+	}
+
+	for _, m := range f.Messages {
+		fields := make(map[string]bool)
+		goNames := make(map[string]string)
+		numbers := make(map[int]bool)
+		for _, n := range m.Reserved {
+			numbers[n] = true
+		}
+		for _, field := range m.Fields {
+			if fields[field.Name] {
+				return errorf(field.Pos, "field %s.%s redeclared", m.Name, field.Name)
+			}
+			if field.Number < 1 {
+				return errorf(field.Pos, "field %s.%s: number must be positive", m.Name, field.Name)
+			}
+			if numbers[field.Number] {
+				return errorf(field.Pos, "field %s.%s: number %d already used or reserved", m.Name, field.Name, field.Number)
+			}
+			goName := GoName(field.Name)
+			if !token.IsExported(goName) {
+				return errorf(field.Pos, "field %s.%s: Go name %s is not exported", m.Name, field.Name, goName)
+			}
+			if other, ok := goNames[goName]; ok {
+				return errorf(field.Pos, "field %s.%s: Go name %s already used by %s", m.Name, field.Name, goName, other)
+			}
+			fields[field.Name] = true
+			goNames[goName] = field.Name
+			numbers[field.Number] = true
+			if err := checkType(field.Pos, field.Type); err != nil {
+				return err
+			}
+		}
+		sort.Ints(m.Reserved)
+	}
+
+	for _, s := range f.Services {
+		methods := make(map[string]bool)
+		for _, m := range s.Methods {
+			if methods[m.Name] {
+				return errorf(m.Pos, "method %s.%s redeclared", s.Name, m.Name)
+			}
+			if !token.IsExported(m.Name) {
+				return errorf(m.Pos, "method %s.%s: name must start with an upper case letter", s.Name, m.Name)
+			}
+			if err := checkSettings(m.Settings); err != nil {
+				return errorf(m.Pos, "method %s.%s: %v", s.Name, m.Name, err)
+			}
+			methods[m.Name] = true
+			for _, t := range []*Type{m.Request, m.Response} {
+				if t == nil {
+					continue
+				}
+				if err := checkType(m.Pos, t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkSettings reports the first invalid setting of a method, by the
+// rules the client applies to ferry tags
+func checkSettings(settings []string) error {
+	hedged, idempotent := false, false
+	for _, setting := range settings {
+		key, value, _ := strings.Cut(setting, "=")
+		switch key {
+		case "name", "oneway":
+		case "idempotent":
+			idempotent = true
+		case "timeout", "hedge":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "hedge" && d > 0 {
+				hedged = true
+			}
+		case "compress":
+			if value != "" && value != "none" && value != "gzip" {
+				return fmt.Errorf("unknown compression %q", value)
+			}
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if hedged && !idempotent {
+		return errors.New("hedged method must be idempotent")
+	}
+	return nil
+}
+
+// GoName returns the Go name of a field, user_id becomes UserId
+func GoName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		r := []rune(part)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+	if b.Len() == 0 {
+		return "X" + name
+	}
+	return b.String()
+}
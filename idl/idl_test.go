@@ -0,0 +1,112 @@
+package idl
+
+import (
+	"strings"
+	"testing"
+)
+
+const arithSource = `package arith;
+
+// Args are the operands
+message Args {
+	int64 a = 1; // first operand
+	int64 b = 2;
+	reserved 3, 4;
+}
+
+message Quotient {
+	int64 quo = 1;
+	int64 rem = 2;
+	repeated string notes = 5;
+	map<string, Args> history = 6;
+}
+
+/* the arith service */
+service Arith {
+	// Multiply returns a * b
+	rpc Multiply(Args) returns (int64);
+	rpc Divide(Args) returns (Quotient) [idempotent, timeout=2s];
+	rpc Reset() returns ();
+}
+`
+
+// Test parsing a well formed file
+func TestParse(t *testing.T) {
+	f, err := Parse("arith.ferry", []byte(arithSource))
+	if err != nil {
+		t.Fatalf("TestParse|Parse|Fail|%v", err)
+		return
+	}
+	if f.Package != "arith" || len(f.Messages) != 2 || len(f.Services) != 1 {
+		t.Fatalf("TestParse|File|Fail|%+v", f)
+		return
+	}
+
+	args := f.Message("Args")
+	if args.Doc != "Args are the operands" || len(args.Fields) != 2 || args.Fields[0].Doc != "" ||
+		args.Field(2).Name != "b" || len(args.Reserved) != 2 {
+		t.Fatalf("TestParse|Args|Fail|%+v", args)
+		return
+	}
+	quo := f.Message("Quotient")
+	if got := quo.Field(5).Type.String(); got != "repeated string" {
+		t.Fatalf("TestParse|notes|Fail|%s", got)
+		return
+	}
+	if got := quo.Field(6).Type.String(); got != "map<string, Args>" {
+		t.Fatalf("TestParse|history|Fail|%s", got)
+		return
+	}
+
+	s := f.Service("Arith")
+	if s.Doc != "" || len(s.Methods) != 3 {
+		t.Fatalf("TestParse|Arith|Fail|%+v", s)
+		return
+	}
+	mul, div, reset := s.Method("Multiply"), s.Method("Divide"), s.Method("Reset")
+	if mul.Doc != "Multiply returns a * b" || mul.Request.Name != "Args" || mul.Response.Kind != Scalar {
+		t.Fatalf("TestParse|Multiply|Fail|%+v", mul)
+		return
+	}
+	if strings.Join(div.Settings, ",") != "idempotent,timeout=2s" {
+		t.Fatalf("TestParse|Divide|Fail|%v", div.Settings)
+		return
+	}
+	if reset.Request != nil || reset.Response != nil {
+		t.Fatalf("TestParse|Reset|Fail|%+v", reset)
+	}
+}
+
+// Test errors report their position
+func TestParse_Errors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"message A { int64 a = 1 }", `x.ferry:1:25: expected ";", found "}"`},
+		{"message A {\n\tB b = 1;\n}", "x.ferry:2:2: undefined type B"},
+		{"message A { int64 a = 1; string b = 1; }", "x.ferry:1:26: field A.b: number 1 already used or reserved"},
+		{"message A { reserved 2; int64 a = 2; }", "x.ferry:1:25: field A.a: number 2 already used or reserved"},
+		{"message A { map<bytes, int64> m = 1; }", "x.ferry:1:13: invalid map key type bytes"},
+		{"message A {}\nservice A {}", "x.ferry:2:1: A redeclared"},
+		{"service S { rpc M(A) returns (); }", "x.ferry:1:13: undefined type A"},
+		{"service S { rpc M() returns () [timeout=]; }", `x.ferry:1:41: expected value, found "]"`},
+		{"enum E {}", `x.ferry:1:1: expected "message" or "service", found "enum"`},
+		{"message A { int64 a = 1; } $", "x.ferry:1:28: unexpected character '$'"},
+		{"message A { int64 user_id = 1; int64 userId = 2; }", "x.ferry:1:32: field A.userId: Go name UserId already used by user_id"},
+		{"message args {}", "x.ferry:1:1: message args: name must start with an upper case letter"},
+		{"service calc {}", "x.ferry:1:1: service calc: name must start with an upper case letter"},
+		{"service S { rpc divide() returns (); }", "x.ferry:1:13: method S.divide: name must start with an upper case letter"},
+		{"service S { rpc M() returns () [timeut=2s]; }", `x.ferry:1:13: method S.M: unknown setting "timeut"`},
+		{"service S { rpc M() returns () [timeout=soon]; }", `x.ferry:1:13: method S.M: invalid timeout "soon"`},
+		{"service S { rpc M() returns () [compress=zstd]; }", `x.ferry:1:13: method S.M: unknown compression "zstd"`},
+		{"service S { rpc M() returns () [hedge=50ms]; }", "x.ferry:1:13: method S.M: hedged method must be idempotent"},
+	}
+	for _, c := range cases {
+		_, err := Parse("x.ferry", []byte(c.src))
+		if err == nil || err.Error() != c.want {
+			t.Fatalf("TestParse_Errors|%q|Fail|%v", c.src, err)
+			return
+		}
+	}
+}
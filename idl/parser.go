@@ -0,0 +1,413 @@
+package idl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// token kinds
+const (
+	tokEOF = iota
+	tokIdent
+	tokNumber
+	tokPunct
+)
+
+// lexer splits a .ferry source in tokens
+type lexer struct {
+	name      string
+	src       string
+	off       int
+	line, col int
+
+	kind int    // kind of the current token
+	text string // text of the current token
+	pos  Pos    // position of the current token
+	doc  string // comment lines right before the current token
+	end  int    // line where the current token ends
+	err  error
+}
+
+// advance moves past the next byte of the source
+func (l *lexer) advance() {
+	if l.src[l.off] == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	l.off++
+}
+
+// next scans the next token
+func (l *lexer) next() {
+	var doc []string
+	lastLine := 0
+	for l.off < len(l.src) {
+		c := l.src[l.off]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			l.advance()
+			continue
+		case strings.HasPrefix(l.src[l.off:], "//"):
+			if lastLine != 0 && l.line > lastLine+1 {
+				// a blank line separates the comment from the token
+				doc = nil
+			}
+			lastLine = l.line
+			trailing := l.line == l.end
+			start := l.off + 2
+			for l.off < len(l.src) && l.src[l.off] != '\n' {
+				l.advance()
+			}
+			if trailing {
+				// comment of the previous token
+				lastLine = 0
+				continue
+			}
+			doc = append(doc, strings.TrimSpace(l.src[start:l.off]))
+			continue
+		case strings.HasPrefix(l.src[l.off:], "/*"):
+			end := strings.Index(l.src[l.off+2:], "*/")
+			if end < 0 {
+				l.fail("comment not terminated")
+				return
+			}
+			for i := 0; i < end+4; i++ {
+				l.advance()
+			}
+			doc = nil
+			continue
+		}
+		break
+	}
+	if lastLine != 0 && l.line > lastLine+1 {
+		doc = nil
+	}
+	l.doc = strings.Join(doc, "\n")
+	l.pos = Pos{Line: l.line, Column: l.col}
+
+	if l.off >= len(l.src) {
+		l.kind, l.text = tokEOF, ""
+		return
+	}
+	start := l.off
+	c := l.src[l.off]
+	switch {
+	case isLetter(c):
+		l.kind = tokIdent
+		for l.off < len(l.src) && (isLetter(l.src[l.off]) || isDigit(l.src[l.off])) {
+			l.advance()
+		}
+	case isDigit(c):
+		// numbers may carry a unit, as in timeout=2s
+		l.kind = tokNumber
+		for l.off < len(l.src) && (isLetter(l.src[l.off]) || isDigit(l.src[l.off]) || l.src[l.off] == '.') {
+			l.advance()
+		}
+	case strings.IndexByte("{}()<>[]=;,", c) >= 0:
+		l.kind = tokPunct
+		l.advance()
+	default:
+		l.fail(fmt.Sprintf("unexpected character %q", c))
+		return
+	}
+	l.text = l.src[start:l.off]
+	l.end = l.line
+}
+
+// fail records the first error of the source
+func (l *lexer) fail(msg string) {
+	if l.err == nil {
+		l.err = &Error{File: l.name, Pos: Pos{Line: l.line, Column: l.col}, Msg: msg}
+	}
+	l.kind, l.text = tokEOF, ""
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// parser builds a File from the tokens of a lexer
+type parser struct {
+	lexer
+}
+
+// errorf returns an error at the current token
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return &Error{File: p.name, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// unexpected returns an error for the current token
+func (p *parser) unexpected(want string) error {
+	if p.kind == tokEOF {
+		return p.errorf("expected %s, found end of file", want)
+	}
+	return p.errorf("expected %s, found %q", want, p.text)
+}
+
+// expect consumes the punctuation or keyword text
+func (p *parser) expect(text string) error {
+	if p.kind == tokEOF || p.text != text {
+		return p.unexpected(fmt.Sprintf("%q", text))
+	}
+	p.next()
+	return nil
+}
+
+// ident consumes an identifier
+func (p *parser) ident() (string, error) {
+	if p.kind != tokIdent {
+		return "", p.unexpected("name")
+	}
+	name := p.text
+	p.next()
+	return name, nil
+}
+
+// number consumes a decimal integer
+func (p *parser) number() (int, error) {
+	if p.kind != tokNumber {
+		return 0, p.unexpected("number")
+	}
+	n, err := strconv.Atoi(p.text)
+	if err != nil {
+		return 0, p.errorf("invalid number %q", p.text)
+	}
+	p.next()
+	return n, nil
+}
+
+func (p *parser) parseFile() (*File, error) {
+	f := &File{Name: p.name}
+	if p.kind == tokIdent && p.text == "package" {
+		p.next()
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		f.Package = name
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+
+	for p.kind != tokEOF {
+		switch p.text {
+		case "message":
+			m, err := p.parseMessage()
+			if err != nil {
+				return nil, err
+			}
+			f.Messages = append(f.Messages, m)
+		case "service":
+			s, err := p.parseService()
+			if err != nil {
+				return nil, err
+			}
+			f.Services = append(f.Services, s)
+		default:
+			return nil, p.unexpected(`"message" or "service"`)
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return f, nil
+}
+
+func (p *parser) parseMessage() (*Message, error) {
+	m := &Message{Doc: p.doc, Pos: p.pos}
+	p.next()
+	var err error
+	if m.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for p.kind != tokEOF && p.text != "}" {
+		if p.kind == tokIdent && p.text == "reserved" {
+			p.next()
+			for {
+				n, err := p.number()
+				if err != nil {
+					return nil, err
+				}
+				m.Reserved = append(m.Reserved, n)
+				if p.text != "," {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		field := &Field{Doc: p.doc, Pos: p.pos}
+		if field.Type, err = p.parseType(); err != nil {
+			return nil, err
+		}
+		if field.Name, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		if field.Number, err = p.number(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+		m.Fields = append(m.Fields, field)
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (p *parser) parseType() (*Type, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "repeated":
+		if p.text == "repeated" {
+			return nil, p.errorf("repeated repeated is not supported, use a message")
+		}
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		return &Type{Kind: Repeated, Elem: elem}, nil
+	case "map":
+		if err := p.expect("<"); err != nil {
+			return nil, err
+		}
+		key, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(">"); err != nil {
+			return nil, err
+		}
+		return &Type{Kind: Map, Key: key, Elem: elem}, nil
+	}
+	if scalars[name] {
+		return &Type{Kind: Scalar, Name: name}, nil
+	}
+	return &Type{Kind: Named, Name: name}, nil
+}
+
+func (p *parser) parseService() (*Service, error) {
+	s := &Service{Doc: p.doc, Pos: p.pos}
+	p.next()
+	var err error
+	if s.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for p.kind != tokEOF && p.text != "}" {
+		m, err := p.parseMethod()
+		if err != nil {
+			return nil, err
+		}
+		s.Methods = append(s.Methods, m)
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *parser) parseMethod() (*Method, error) {
+	m := &Method{Doc: p.doc, Pos: p.pos}
+	if err := p.expect("rpc"); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if m.Request, err = p.parseParen(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("returns"); err != nil {
+		return nil, err
+	}
+	if m.Response, err = p.parseParen(); err != nil {
+		return nil, err
+	}
+
+	if p.text == "[" {
+		p.next()
+		for {
+			// a setting is a name, optionally followed by = and a value
+			setting, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if p.text == "=" {
+				p.next()
+				if p.kind != tokIdent && p.kind != tokNumber {
+					return nil, p.unexpected("value")
+				}
+				setting += "=" + p.text
+				p.next()
+			}
+			m.Settings = append(m.Settings, setting)
+			if p.text != "," {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseParen parses an optional type in parentheses
+func (p *parser) parseParen() (*Type, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.text == ")" {
+		p.next()
+		return nil, nil
+	}
+	t, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -14,6 +15,15 @@ type MessageType byte
 const (
 	MsgTypeRequest MessageType = iota
 	MsgTypeResponse
+	MsgTypeCancel // asks the server to cancel the request with the same SeqID, no body
+	MsgTypeOneway // a request the server doesn't answer
+)
+
+// Extension bits of the header
+const (
+	// ExtCancel, set on responses, tells the client the server
+	// handles MsgTypeCancel; older servers close the connection
+	ExtCancel uint32 = 1 << iota
 )
 
 // CompressType represents compress method for the message
@@ -22,8 +32,13 @@ type CompressType byte
 const (
 	//without compress
 	NoneCompress CompressType = iota
+	//gzip compressed body
+	GzipCompress
 )
 
+// MaxBodySize is the largest body a compressed message decompresses to
+const MaxBodySize = 64 << 20
+
 // Header represents message header
 type Header struct {
 	Version      byte
@@ -106,6 +121,51 @@ func (m *Message) Encode() []byte {
 	return b.Bytes()
 }
 
+// SetBody sets the body of the message, compressed according to m.CompressType
+func (m *Message) SetBody(data []byte) error {
+	switch m.CompressType {
+	case NoneCompress:
+	case GzipCompress:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = b.Bytes()
+	default:
+		return fmt.Errorf("unknown compress type %d", m.CompressType)
+	}
+	m.Data = data
+	m.BodyLength = uint32(len(data))
+	return nil
+}
+
+// body returns the uncompressed body of the message
+func (m *Message) body() ([]byte, error) {
+	switch m.CompressType {
+	case NoneCompress:
+		return m.Data, nil
+	case GzipCompress:
+		r, err := gzip.NewReader(bytes.NewReader(m.Data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, MaxBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxBodySize {
+			return nil, fmt.Errorf("decompressed body exceeds %d bytes", MaxBodySize)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown compress type %d", m.CompressType)
+}
+
 // RecvMessage reads and wraps the message from the reader
 func RecvMessage(r io.Reader) (*Message, error) {
 	//TODO reuse message object
@@ -147,6 +207,31 @@ type RawRequest struct {
 	Args   []json.RawMessage `json:"args"`   //in args
 }
 
+// error codes carried by Response.ErrCode
+const (
+	CodeOK                 uint = iota
+	CodeApplication             // the method returned an error
+	CodeInvalidRequest          // the request can't be decoded or doesn't match the method
+	CodeServiceUnavailable      // the service is not registered, or was removed
+	CodeMethodNotFound          // the service has no such method
+	CodeInternal                // the server failed to handle the request
+)
+
+// Error represents an error reported by the remote side of a RPC call
+type Error struct {
+	Code    uint
+	Message string
+}
+
+// Errorf creates an error with code and formatted message
+func Errorf(code uint, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
 // Response represents the basic response struct for RPC call
 type Response struct {
 	ErrCode uint          `json:"code"`
@@ -163,13 +248,17 @@ type RawResponse struct {
 
 // DecodeRequest gets the RPC request body
 func (m *Message) DecodeRequest() (*RawRequest, error) {
-	if m == nil || m.MessageType != MsgTypeRequest || len(m.Data) <= 0 {
+	if m == nil || (m.MessageType != MsgTypeRequest && m.MessageType != MsgTypeOneway) || len(m.Data) <= 0 {
 		// invalid input
 		return nil, fmt.Errorf("invalid message")
 	}
 
+	data, err := m.body()
+	if err != nil {
+		return nil, err
+	}
 	var req RawRequest
-	err := json.Unmarshal(m.Data, &req)
+	err = json.Unmarshal(data, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -184,8 +273,12 @@ func (m *Message) DecodeResponse() (*RawResponse, error) {
 		return nil, fmt.Errorf("invalid message")
 	}
 
+	data, err := m.body()
+	if err != nil {
+		return nil, err
+	}
 	var resp RawResponse
-	err := json.Unmarshal(m.Data, &resp)
+	err = json.Unmarshal(data, &resp)
 	if err != nil {
 		return nil, err
 	}
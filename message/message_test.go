@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/google/go-cmp/cmp"
+	"strings"
 	"testing"
 )
 
@@ -76,3 +77,35 @@ func TestMessage_EncodeAndRecv(t *testing.T) {
 		t.Fatalf(diff)
 	}
 }
+
+// Test gzip compressed bodies survive encode and receive
+func TestMessage_Compress(t *testing.T) {
+	body, _ := json.Marshal(&Request{Path: "Arith", Method: "Echo", Args: []interface{}{"ferry ferry ferry ferry"}})
+	msg := Message{Header: &Header{MessageType: MsgTypeRequest, CompressType: GzipCompress, SeqID: 3}}
+	if err := msg.SetBody(body); err != nil {
+		t.Fatalf("TestMessage_Compress|SetBody|Fail|%v", err)
+		return
+	}
+
+	m, err := RecvMessage(bytes.NewReader(msg.Encode()))
+	if err != nil || m.CompressType != GzipCompress {
+		t.Fatalf("TestMessage_Compress|RecvMessage|Fail|%v", err)
+		return
+	}
+	req, err := m.DecodeRequest()
+	if err != nil || req.Method != "Echo" || string(req.Args[0]) != `"ferry ferry ferry ferry"` {
+		t.Fatalf("TestMessage_Compress|DecodeRequest|Fail|%v|%+v", err, req)
+	}
+}
+
+// Test a compressed body decompressing past MaxBodySize is refused
+func TestMessage_CompressLimit(t *testing.T) {
+	msg := Message{Header: &Header{MessageType: MsgTypeRequest, CompressType: GzipCompress, SeqID: 4}}
+	if err := msg.SetBody(make([]byte, MaxBodySize+1)); err != nil {
+		t.Fatalf("TestMessage_CompressLimit|SetBody|Fail|%v", err)
+		return
+	}
+	if _, err := msg.DecodeRequest(); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("TestMessage_CompressLimit|DecodeRequest|Fail|%v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/transport"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dial connects to address (see transport.Dial) and returns a
+// connection sending each request on its own stream
+func Dial(address string) (net.Conn, error) {
+	conn, err := transport.Dial(context.Background(), address)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(Client(conn)), nil
+}
+
+// callConn is the connection of a client over a session: each request is
+// written on a new stream and the responses are read back whole, in the
+// order they complete
+type callConn struct {
+	sess *Session
+
+	mu    sync.Mutex
+	calls map[uint64]*Stream // streams of the calls waiting for their response
+
+	resps   chan []byte
+	readBuf bytes.Buffer // rest of the response being read
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// NewConn returns a connection for client.NewClient sending each request on
+// a new stream of sess, so a large call doesn't delay the others
+func NewConn(sess *Session) net.Conn {
+	return &callConn{
+		sess:  sess,
+		calls: make(map[uint64]*Stream),
+		resps: make(chan []byte),
+		done:  make(chan struct{}),
+	}
+}
+
+// Write sends a message, p must hold exactly one
+func (c *callConn) Write(p []byte) (int, error) {
+	r := bytes.NewReader(p)
+	h, err := message.DecodeHeader(r)
+	if err != nil || int(h.BodyLength) != r.Len() {
+		return 0, errors.New("mux: a write must hold one message")
+	}
+	select {
+	case <-c.done:
+		return 0, c.err
+	default:
+	}
+
+	switch h.MessageType {
+	case message.MsgTypeRequest:
+		st, err := c.sess.Open()
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.calls[h.SeqID] = st
+		c.mu.Unlock()
+		if _, err := st.Write(p); err != nil {
+			c.forget(h.SeqID)
+			st.Close()
+			if c.sess.closeErr() != nil {
+				return 0, err
+			}
+			// only the stream failed, the call fails with its response
+			go c.deliver(errorResponse(h.SeqID, err))
+			return len(p), nil
+		}
+		go c.receive(h.SeqID, st)
+	case message.MsgTypeOneway:
+		st, err := c.sess.Open()
+		if err != nil {
+			return 0, err
+		}
+		defer st.Close()
+		if _, err := st.Write(p); err != nil {
+			return 0, err
+		}
+	case message.MsgTypeCancel:
+		c.mu.Lock()
+		st := c.calls[h.SeqID]
+		c.mu.Unlock()
+		if st != nil {
+			// the call may complete meanwhile
+			st.Write(p)
+		}
+	default:
+		return 0, errors.New("mux: unexpected message type")
+	}
+	return len(p), nil
+}
+
+// receive reads the response of the call seq and hands it to Read
+func (c *callConn) receive(seq uint64, st *Stream) {
+	msg, err := message.RecvMessage(st)
+	c.forget(seq)
+	st.Close()
+	if err != nil {
+		if sessErr := c.sess.closeErr(); sessErr != nil {
+			c.fail(sessErr)
+			return
+		}
+		// only the stream failed, the other calls go on
+		msg = errorResponse(seq, err)
+	}
+	c.deliver(msg)
+}
+
+// deliver hands a response to Read
+func (c *callConn) deliver(msg *message.Message) {
+	select {
+	case c.resps <- msg.Encode():
+	case <-c.done:
+	}
+}
+
+// errorResponse returns the response failing the call seq with err
+func errorResponse(seq uint64, err error) *message.Message {
+	code, text := message.CodeInternal, "mux: response stream: "+err.Error()
+	if err == ErrStreamReset {
+		// refused before the server read the request, the call didn't run
+		code, text = message.CodeServiceUnavailable, err.Error()
+	}
+	data, _ := json.Marshal(&message.Response{ErrCode: code, Error: text})
+	msg := &message.Message{Header: &message.Header{MessageType: message.MsgTypeResponse, SeqID: seq}}
+	msg.SetBody(data)
+	return msg
+}
+
+// forget removes the call seq
+func (c *callConn) forget(seq uint64) {
+	c.mu.Lock()
+	delete(c.calls, seq)
+	c.mu.Unlock()
+}
+
+// fail closes the connection with err
+func (c *callConn) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.sess.Close()
+	})
+}
+
+// Read reads the responses, one after the other
+func (c *callConn) Read(p []byte) (int, error) {
+	if c.readBuf.Len() == 0 {
+		select {
+		case b := <-c.resps:
+			c.readBuf.Write(b)
+		case <-c.done:
+			return 0, c.err
+		}
+	}
+	return c.readBuf.Read(p)
+}
+
+// Close closes the session
+func (c *callConn) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+func (c *callConn) LocalAddr() net.Addr {
+	return c.sess.conn.LocalAddr()
+}
+
+func (c *callConn) RemoteAddr() net.Addr {
+	return c.sess.conn.RemoteAddr()
+}
+
+func (c *callConn) SetDeadline(t time.Time) error {
+	return c.sess.conn.SetDeadline(t)
+}
+
+func (c *callConn) SetReadDeadline(t time.Time) error {
+	return c.sess.conn.SetReadDeadline(t)
+}
+
+func (c *callConn) SetWriteDeadline(t time.Time) error {
+	return c.sess.conn.SetWriteDeadline(t)
+}
+
+// listener accepts the streams of the sessions of the connections of lis
+type listener struct {
+	lis     net.Listener
+	streams chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// NewListener returns a listener accepting the streams of the connections
+// accepted by lis, for Server.Serve to serve each stream as a connection
+func NewListener(lis net.Listener) net.Listener {
+	l := &listener{
+		lis:     lis,
+		streams: make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *listener) acceptLoop() {
+	for {
+		conn, err := l.lis.Accept()
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		go l.serve(Server(conn))
+	}
+}
+
+// serve forwards the streams of sess to Accept
+func (l *listener) serve(sess *Session) {
+	defer sess.Close()
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- st:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *listener) fail(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+		l.lis.Close()
+	})
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case st := <-l.streams:
+		return st, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *listener) Close() error {
+	l.fail(net.ErrClosed)
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.lis.Addr()
+}
@@ -0,0 +1,323 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sunlidea/ferry/client"
+	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/server"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test a stream whose reader is stalled doesn't block the others
+func TestSession_FlowControl(t *testing.T) {
+	a, b := net.Pipe()
+	cli, srv := Client(a), Server(b)
+	defer cli.Close()
+	defer srv.Close()
+
+	big := bytes.Repeat([]byte("ferry"), 200<<10)
+	st, err := cli.Open()
+	if err != nil {
+		t.Fatalf("TestSession_FlowControl|Open|Fail|%v", err)
+		return
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(big)
+		st.Close()
+		written <- err
+	}()
+	stalled, err := srv.Accept()
+	if err != nil {
+		t.Fatalf("TestSession_FlowControl|Accept|Fail|%v", err)
+		return
+	}
+
+	// another stream goes through while the first one waits for its window
+	st2, _ := cli.Open()
+	go st2.Write([]byte("ping"))
+	other, _ := srv.Accept()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(other, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("TestSession_FlowControl|ping|Fail|%v|%q", err, buf)
+		return
+	}
+	go other.Write([]byte("pong"))
+	if _, err := io.ReadFull(st2, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("TestSession_FlowControl|pong|Fail|%v|%q", err, buf)
+		return
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("TestSession_FlowControl|window|Fail|write done %v", err)
+		return
+	default:
+	}
+
+	// reading opens the window, the data ends with the close of the stream
+	got, err := io.ReadAll(stalled)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("TestSession_FlowControl|ReadAll|Fail|%v|%d", err, len(got))
+		return
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("TestSession_FlowControl|Write|Fail|%v", err)
+		return
+	}
+
+	other.Close()
+	if _, err := st2.Read(buf); err != io.EOF {
+		t.Fatalf("TestSession_FlowControl|EOF|Fail|%v", err)
+		return
+	}
+	if _, err := st2.Write(buf); err == nil {
+		t.Fatalf("TestSession_FlowControl|write closed|Fail|no error")
+		return
+	}
+
+	cli.Close()
+	if _, err := other.Read(buf); err == nil {
+		t.Fatalf("TestSession_FlowControl|session closed|Fail|no error")
+	}
+}
+
+type Echo int
+
+func (e *Echo) Add(a, b int) (int, error) {
+	return a + b, nil
+}
+
+func (e *Echo) Repeat(s string, n int) (string, error) {
+	return strings.Repeat(s, n), nil
+}
+
+type EchoProxy struct {
+	Add    func(a, b int) (int, error)
+	Repeat func(s string, n int) (string, error)
+}
+
+// Test ferry calls sharing a multiplexed connection
+func TestDial(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Echo)); err != nil {
+		t.Fatalf("TestDial|Register|Fail|%v", err)
+		return
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestDial|Listen|Fail|%v", err)
+		return
+	}
+	mlis := NewListener(lis)
+	defer mlis.Close()
+	go s.Serve(mlis)
+
+	conn, err := Dial(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("TestDial|Dial|Fail|%v", err)
+		return
+	}
+	c := client.NewClient(conn, "Echo", new(EchoProxy))
+	defer c.Close()
+	proxy := c.GetService().(*EchoProxy)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 21)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s, err := proxy.Repeat("ferry", 1<<20)
+		if err == nil && len(s) != 5<<20 {
+			err = io.ErrShortBuffer
+		}
+		errs <- err
+	}()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sum, err := proxy.Add(i, 1)
+			if err == nil && sum != i+1 {
+				err = io.ErrUnexpectedEOF
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("TestDial|call|Fail|%v", err)
+			return
+		}
+	}
+}
+
+// Test streams refused by the peer fail with ErrStreamReset, the session goes on
+func TestSession_Reset(t *testing.T) {
+	a, b := net.Pipe()
+	cli, srv := Client(a), Server(b)
+	defer cli.Close()
+	defer srv.Close()
+
+	streams := make([]*Stream, acceptQueue+1)
+	for i := range streams {
+		st, err := cli.Open()
+		if err != nil {
+			t.Fatalf("TestSession_Reset|Open|Fail|%v", err)
+			return
+		}
+		if _, err := st.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("TestSession_Reset|Write|Fail|%v", err)
+			return
+		}
+		streams[i] = st
+	}
+	// the accept queue is full, the last stream is refused
+	buf := make([]byte, 1)
+	if _, err := streams[acceptQueue].Read(buf); err != ErrStreamReset {
+		t.Fatalf("TestSession_Reset|Read|Fail|%v", err)
+		return
+	}
+	if _, err := streams[acceptQueue].Write(buf); err != ErrStreamReset {
+		t.Fatalf("TestSession_Reset|Write reset|Fail|%v", err)
+		return
+	}
+
+	first, err := srv.Accept()
+	if err != nil {
+		t.Fatalf("TestSession_Reset|Accept|Fail|%v", err)
+		return
+	}
+	if _, err := io.ReadFull(first, buf); err != nil || buf[0] != 0 {
+		t.Fatalf("TestSession_Reset|first|Fail|%v|%v", err, buf)
+	}
+}
+
+// Test a call whose stream ends without response fails alone
+func TestConn_StreamFailure(t *testing.T) {
+	a, b := net.Pipe()
+	srv := Server(b)
+	defer srv.Close()
+	c := client.NewClient(NewConn(Client(a)), "Echo", new(EchoProxy))
+	defer c.Close()
+	proxy := c.GetService().(*EchoProxy)
+
+	go func() {
+		// the first stream is closed before the response
+		st, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		message.RecvMessage(st)
+		st.Close()
+
+		st, err = srv.Accept()
+		if err != nil {
+			return
+		}
+		req, err := message.RecvMessage(st)
+		if err != nil {
+			return
+		}
+		data, _ := json.Marshal(&message.Response{Result: []interface{}{3, nil}})
+		resp := &message.Message{Header: &message.Header{MessageType: message.MsgTypeResponse, SeqID: req.SeqID}}
+		resp.SetBody(data)
+		st.Write(resp.Encode())
+		st.Close()
+	}()
+
+	_, err := proxy.Add(1, 2)
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeInternal {
+		t.Fatalf("TestConn_StreamFailure|first|Fail|%v", err)
+		return
+	}
+	if sum, err := proxy.Add(1, 2); err != nil || sum != 3 {
+		t.Fatalf("TestConn_StreamFailure|second|Fail|%v|%d", err, sum)
+	}
+}
+
+func (e *Echo) Len(s string) (int, error) {
+	return len(s), nil
+}
+
+type LenProxy struct {
+	Add func(a, b int) (int, error)
+	Len func(s string) (int, error)
+}
+
+// holdListener holds back the first connection it accepts
+type holdListener struct {
+	net.Listener
+	held chan net.Conn
+}
+
+func (l *holdListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || l.held == nil {
+		return conn, err
+	}
+	l.held <- conn
+	l.held = nil
+	return l.Listener.Accept()
+}
+
+// Test a large request doesn't delay the small calls sent after it
+func TestDial_LargeRequest(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Echo)); err != nil {
+		t.Fatalf("TestDial_LargeRequest|Register|Fail|%v", err)
+		return
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestDial_LargeRequest|Listen|Fail|%v", err)
+		return
+	}
+	held := make(chan net.Conn, 1)
+	mlis := &holdListener{Listener: NewListener(lis), held: held}
+	defer mlis.Close()
+	go s.Serve(mlis)
+
+	conn, err := Dial(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("TestDial_LargeRequest|Dial|Fail|%v", err)
+		return
+	}
+	c := client.NewClient(conn, "Echo", new(LenProxy))
+	defer c.Close()
+	proxy := c.GetService().(*LenProxy)
+
+	large := make(chan error, 1)
+	go func() {
+		n, err := proxy.Len(strings.Repeat("x", 50<<20))
+		if err == nil && n != 50<<20 {
+			err = io.ErrShortBuffer
+		}
+		large <- err
+	}()
+	// the server doesn't read the large request, its stream waits for the window
+	st := <-held
+	for i := 0; i < 10; i++ {
+		if sum, err := proxy.Add(i, 1); err != nil || sum != i+1 {
+			t.Fatalf("TestDial_LargeRequest|Add|Fail|%v|%d", err, sum)
+			return
+		}
+	}
+	select {
+	case err := <-large:
+		t.Fatalf("TestDial_LargeRequest|Len|Fail|done before read|%v", err)
+		return
+	default:
+	}
+
+	go s.ServeConn(st)
+	if err := <-large; err != nil {
+		t.Fatalf("TestDial_LargeRequest|Len|Fail|%v", err)
+	}
+}
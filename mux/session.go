@@ -0,0 +1,273 @@
+// Package mux multiplexes logical streams over one connection, so a large
+// call doesn't hold back the others sharing the connection.
+//
+// Streams carry their data in frames of at most 16 KiB, interleaved on the
+// connection, and each has a window of 256 KiB: a sender stops when the
+// receiver hasn't read that much yet, leaving the connection to the other
+// streams. Frames start with a 12 byte header:
+//
+//	version  uint8
+//	type     uint8   data, window update
+//	flags    uint16  SYN opens the stream, FIN closes it, RST refuses it
+//	stream   uint32  odd when opened by the client, even by the server
+//	length   uint32  size of the data, or increment of the window
+//
+// A refused stream is closed with RST and FIN, its reads and writes fail
+// with ErrStreamReset, peers not knowing RST see the end of the stream.
+//
+// Servers serve the streams of the connections they accept, clients send
+// each request on its own stream with NewConn, so neither a large request
+// nor a large response delays the calls on the other streams. A stream
+// failing fails its call only, the others go on:
+//
+//	s.Serve(mux.NewListener(lis))
+//
+//	conn, err := mux.Dial("localhost:1234")
+//	c := client.NewClient(conn, "Arith", new(api.ArithProxy))
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	version = 0
+
+	// frame types
+	typeData         = 0
+	typeWindowUpdate = 1
+
+	// frame flags
+	flagSYN = 1
+	flagFIN = 2
+	flagRST = 4
+
+	headerSize   = 12
+	windowSize   = 256 << 10 // initial window of the streams
+	maxFrameSize = 16 << 10  // largest data frame
+	acceptQueue  = 256       // streams opened by the peer waiting for Accept
+)
+
+// ErrSessionClosed is returned by the streams of a closed session
+var ErrSessionClosed = errors.New("mux: session closed")
+
+// ErrStreamReset is returned by the streams refused by the peer
+var ErrStreamReset = errors.New("mux: stream reset by peer")
+
+// Session multiplexes streams over a connection
+type Session struct {
+	conn   net.Conn
+	client bool
+
+	writeMu sync.Mutex // a frame is written at once
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // why the session is closed
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// Client returns the session of the client end of conn
+func Client(conn net.Conn) *Session {
+	return newSession(conn, true)
+}
+
+// Server returns the session of the server end of conn
+func Server(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, acceptQueue),
+		done:    make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream, the peer sees it with its first write
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID, true)
+	s.nextID += 2
+	s.streams[st.id] = st
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// Close closes the connection and every stream
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// Addr returns the local address of the connection
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// closeErr returns why the session is closed
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail closes the session with err
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.done)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// remove forgets the stream id, later frames of it are ignored
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame writes a frame, length is the size of payload
+// or the increment of a window update
+func (s *Session) writeFrame(typ byte, flags uint16, id uint32, length uint32, payload []byte) error {
+	var hdr [headerSize]byte
+	hdr[0] = version
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:], flags)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	binary.BigEndian.PutUint32(hdr[8:], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+	bufs := net.Buffers{hdr[:], payload}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads the frames of the connection and dispatches them to the streams
+func (s *Session) recvLoop() {
+	r := bufio.NewReaderSize(s.conn, maxFrameSize+headerSize)
+	var hdr [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		if hdr[0] != version {
+			s.fail(fmt.Errorf("mux: unsupported version %d", hdr[0]))
+			return
+		}
+		typ := hdr[1]
+		flags := binary.BigEndian.Uint16(hdr[2:])
+		id := binary.BigEndian.Uint32(hdr[4:])
+		length := binary.BigEndian.Uint32(hdr[8:])
+
+		var err error
+		switch typ {
+		case typeData:
+			err = s.handleData(r, flags, id, length)
+		case typeWindowUpdate:
+			s.mu.Lock()
+			st := s.streams[id]
+			s.mu.Unlock()
+			if st != nil {
+				st.grant(length)
+			}
+		default:
+			err = fmt.Errorf("mux: unknown frame type %d", typ)
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// handleData reads the payload of a data frame into its stream
+func (s *Session) handleData(r *bufio.Reader, flags uint16, id uint32, length uint32) error {
+	if length > maxFrameSize {
+		return fmt.Errorf("mux: frame of %d bytes exceeds %d", length, maxFrameSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	if st == nil && flags&flagSYN != 0 {
+		if (id%2 == 1) == s.client {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: stream %d opened with the wrong parity", id)
+		}
+		st = newStream(s, id, false)
+		select {
+		case s.accept <- st:
+			s.streams[id] = st
+		default:
+			// too many streams waiting, refuse this one
+			s.mu.Unlock()
+			return s.writeFrame(typeData, flagFIN|flagRST, id, 0, nil)
+		}
+	}
+	if st != nil && flags&(flagFIN|flagRST) != 0 {
+		delete(s.streams, id)
+	}
+	s.mu.Unlock()
+
+	if st == nil {
+		// closed locally, the peer didn't know yet
+		return nil
+	}
+	return st.receive(payload, flags&flagFIN != 0, flags&flagRST != 0)
+}
@@ -0,0 +1,253 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection of a session
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	writeMu sync.Mutex // a write is sent at once, as on a net.Conn
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // bytes the peer may still send
+	unacked       uint32 // bytes read and not granted back to the peer yet
+	sendWindow    uint32 // bytes we may still send
+	synPending    bool   // opened locally, the first frame carries SYN
+	localClosed   bool
+	remoteClosed  bool
+	reset         bool  // refused by the peer
+	err           error // error of the session
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(sess *Session, id uint32, local bool) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       sess,
+		recvWindow: windowSize,
+		sendWindow: windowSize,
+		synPending: local,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// receive buffers the data of the peer, fin closes the stream
+// and rst drops it
+func (st *Stream) receive(data []byte, fin, rst bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("mux: stream %d exceeded its window", st.id)
+	}
+	st.recvWindow -= uint32(len(data))
+	if !st.localClosed {
+		st.recvBuf.Write(data)
+	}
+	if fin {
+		st.remoteClosed = true
+	}
+	if rst {
+		st.remoteClosed = true
+		st.reset = true
+		st.recvBuf.Reset()
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// grant adds n bytes to the send window
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// fail closes the stream with the error of the session
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	st.err = err
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// expired reports whether the deadline t passed
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// Read reads the data of the peer, it returns io.EOF once the
+// peer closed the stream and the data was read
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.recvBuf.Len() == 0 {
+		switch {
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			st.mu.Unlock()
+			return 0, st.err
+		case expired(st.readDeadline):
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.recvBuf.Read(p)
+
+	// give the window back once half of it was read
+	var update uint32
+	st.unacked += uint32(n)
+	if st.unacked >= windowSize/2 && !st.remoteClosed {
+		update = st.unacked
+		st.recvWindow += update
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+
+	if update > 0 {
+		st.sess.writeFrame(typeWindowUpdate, 0, st.id, update, nil)
+	}
+	return n, nil
+}
+
+// Write sends p in frames, waiting for the peer to open the window
+func (st *Stream) Write(p []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.localClosed && !st.remoteClosed && st.err == nil && !expired(st.writeDeadline) {
+			st.cond.Wait()
+		}
+		switch {
+		case st.localClosed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.err != nil:
+			st.mu.Unlock()
+			return written, st.err
+		case expired(st.writeDeadline):
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(p)
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		st.sendWindow -= uint32(n)
+		var flags uint16
+		if st.synPending {
+			flags = flagSYN
+			st.synPending = false
+		}
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(typeData, flags, st.id, uint32(n), p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream both ways, the data written so far is delivered
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	// the peer doesn't know a stream opened locally before its first frame
+	notify := !st.remoteClosed && !st.synPending && st.err == nil
+	st.recvBuf.Reset()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.sess.remove(st.id)
+	if notify {
+		return st.sess.writeFrame(typeData, flagFIN, st.id, 0, nil)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the session
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the reads of the stream
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.wakeAt(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the writes of the stream
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes the waiting reads and writes at t, to check their deadline
+func (st *Stream) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		st.mu.Lock()
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	})
+}
@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/sunlidea/ferry/client"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy is the client definition of the Registry service
+type Proxy struct {
+	Register   func(lease *Lease) (bool, error)
+	Renew      func(lease *Lease) (bool, error)
+	Deregister func(lease *Lease) (bool, error)
+	Lookup     func(service string) (*Addresses, error)
+	Watch      func(req *WatchRequest) (*Addresses, error)
+}
+
+// Announcement keeps the address of a service registered
+// in a registry until it is closed
+type Announcement struct {
+	lease  Lease
+	c      *client.Client
+	proxy  *Proxy
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Announce registers address as serving service in the registry at
+// registryAddr, and renews the lease every ttl/3 until Close is called
+func Announce(network, registryAddr, service, address string, ttl time.Duration) (*Announcement, error) {
+	if ttl/3 <= 0 {
+		return nil, errors.New("registry: TTL too short to be renewed: " + ttl.String())
+	}
+	c, err := client.Dail(network, registryAddr, ServiceName, new(Proxy),
+		client.WithReconnect(client.Reconnect{}))
+	if err != nil {
+		return nil, err
+	}
+	a := &Announcement{
+		lease: Lease{Service: service, Address: address, TTL: ttl},
+		c:     c,
+		proxy: c.GetService().(*Proxy),
+		done:  make(chan struct{}),
+	}
+	if _, err := a.proxy.Register(&a.lease); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go a.heartbeat(ctx)
+	return a, nil
+}
+
+// heartbeat renews the lease, registering again if it expired meanwhile
+func (a *Announcement) heartbeat(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(a.lease.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := a.proxy.Renew(&a.lease)
+		if err != nil {
+			log.Print("registry.Announcement: Renew Fail: ", err.Error())
+			continue
+		}
+		if !ok {
+			if _, err := a.proxy.Register(&a.lease); err != nil {
+				log.Print("registry.Announcement: Register Fail: ", err.Error())
+			}
+		}
+	}
+}
+
+// Close stops the heartbeats and removes the address from the registry
+func (a *Announcement) Close() error {
+	var err error
+	a.once.Do(func() {
+		a.cancel()
+		<-a.done
+		_, err = a.proxy.Deregister(&a.lease)
+		a.c.Close()
+	})
+	return err
+}
+
+// Resolver resolves services through the registry at an address,
+// it implements resolver.Resolver
+type Resolver struct {
+	Network string
+	Address string
+}
+
+// NewResolver returns a resolver watching the registry at address
+func NewResolver(network, address string) *Resolver {
+	return &Resolver{Network: network, Address: address}
+}
+
+// Resolve looks up the addresses of the service, then watches
+// the registry and sends the new addresses on every change
+func (r *Resolver) Resolve(ctx context.Context, service string) (<-chan []string, error) {
+	conn, err := net.Dial(r.Network, r.Address)
+	if err != nil {
+		return nil, err
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial(r.Network, r.Address)
+	}
+	c := client.NewClient(conn, ServiceName, new(Proxy),
+		client.WithDialer(dial), client.WithReconnect(client.Reconnect{Policy: client.QueuePending}))
+
+	current, err := client.Invoke[string, Addresses](ctx, c, ServiceName+".Lookup", &service)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	ch := make(chan []string, 1)
+	ch <- current.Addresses
+	go func() {
+		defer close(ch)
+		defer c.Close()
+		failures := 0
+		for {
+			next, err := client.Invoke[WatchRequest, Addresses](ctx, c, ServiceName+".Watch",
+				&WatchRequest{Service: service, Revision: current.Revision})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Print("registry.Resolver: Watch Fail: ", err.Error())
+				failures++
+				select {
+				case <-time.After(client.DefaultBackoff.Delay(failures)):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			failures = 0
+			if next.Revision == current.Revision {
+				// timed out without change
+				continue
+			}
+			current = next
+			select {
+			case ch <- current.Addresses:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServiceName is the name the Registry is published under
+const ServiceName = "Registry"
+
+// MaxWatchTime bounds how long a Watch call blocks
+const MaxWatchTime = time.Minute
+
+// Lease registers the address of a service for TTL
+type Lease struct {
+	Service string
+	Address string
+	TTL     time.Duration
+}
+
+// Addresses is the set of addresses of a service at a revision
+type Addresses struct {
+	Service   string
+	Revision  uint64
+	Addresses []string
+}
+
+// WatchRequest asks for the addresses of a service once their
+// revision differs from Revision, or after Timeout
+type WatchRequest struct {
+	Service  string
+	Revision uint64
+	Timeout  time.Duration
+}
+
+// entry holds the leases of a service
+type entry struct {
+	leases   map[string]time.Time // address -> expiry
+	revision uint64
+	changed  chan struct{} // closed on every change
+}
+
+// Registry is a ferry service keeping service -> address leases.
+// Servers register their address with a TTL and renew it with heartbeats,
+// clients look up or watch the addresses of a service.
+type Registry struct {
+	mutex    sync.Mutex
+	services map[string]*entry // services with live leases
+	revision uint64            // last revision of any service
+	added    chan struct{}     // closed when a service gets its entry
+}
+
+// New creates an empty registry, publish it with Server.Register
+func New() *Registry {
+	return &Registry{
+		services: make(map[string]*entry),
+		added:    make(chan struct{}),
+	}
+}
+
+// Register adds or renews the lease of an address
+func (r *Registry) Register(lease *Lease) (bool, error) {
+	if lease.Service == "" || lease.Address == "" || lease.TTL <= 0 {
+		return false, errors.New("registry: lease needs a service, an address and a TTL")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.services[lease.Service]
+	if !ok {
+		e = &entry{leases: make(map[string]time.Time), changed: make(chan struct{})}
+		r.services[lease.Service] = e
+		close(r.added)
+		r.added = make(chan struct{})
+	}
+	_, renewed := e.leases[lease.Address]
+	e.leases[lease.Address] = time.Now().Add(lease.TTL)
+	if !renewed {
+		r.notify(e)
+	}
+	return true, nil
+}
+
+// Renew extends the lease of an address, it returns false
+// if the lease expired and the address must be registered again
+func (r *Registry) Renew(lease *Lease) (bool, error) {
+	if lease.TTL <= 0 {
+		return false, errors.New("registry: lease needs a TTL")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e := r.services[lease.Service]
+	if e == nil {
+		return false, nil
+	}
+	r.expire(lease.Service, e)
+	if _, ok := e.leases[lease.Address]; !ok {
+		return false, nil
+	}
+	e.leases[lease.Address] = time.Now().Add(lease.TTL)
+	return true, nil
+}
+
+// Deregister removes the lease of an address
+func (r *Registry) Deregister(lease *Lease) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e := r.services[lease.Service]
+	if e == nil {
+		return false, nil
+	}
+	if _, ok := e.leases[lease.Address]; !ok {
+		return false, nil
+	}
+	delete(e.leases, lease.Address)
+	r.notify(e)
+	r.drop(lease.Service, e)
+	return true, nil
+}
+
+// Lookup returns the live addresses of a service
+func (r *Registry) Lookup(service string) (*Addresses, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.lookup(service), nil
+}
+
+// lookup returns the live addresses of a service, r.mutex must be held
+func (r *Registry) lookup(service string) *Addresses {
+	e := r.services[service]
+	if e == nil {
+		return &Addresses{Service: service, Addresses: []string{}}
+	}
+	r.expire(service, e)
+	return e.addresses(service)
+}
+
+// Watch blocks until the revision of the service differs from the requested
+// one, or the timeout passes, then returns the live addresses
+func (r *Registry) Watch(req *WatchRequest) (*Addresses, error) {
+	timeout := req.Timeout
+	if timeout <= 0 || timeout > MaxWatchTime {
+		timeout = MaxWatchTime
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.mutex.Lock()
+		addresses := r.lookup(req.Service)
+		if addresses.Revision != req.Revision {
+			r.mutex.Unlock()
+			return addresses, nil
+		}
+		// wait for the first lease of an unknown service
+		changed := r.added
+		var next time.Time
+		if e := r.services[req.Service]; e != nil {
+			changed = e.changed
+			// wake up when the next lease expires
+			next = r.nextExpiry(e)
+		}
+		r.mutex.Unlock()
+
+		var expiry <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			expiry = timer.C
+		}
+		timeout := false
+		select {
+		case <-changed:
+		case <-expiry:
+		case <-deadline.C:
+			timeout = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if timeout {
+			return r.Lookup(req.Service)
+		}
+	}
+}
+
+// drop forgets the entry of a service without leases, r.mutex must be held
+func (r *Registry) drop(service string, e *entry) {
+	if len(e.leases) == 0 {
+		delete(r.services, service)
+	}
+}
+
+// expire drops the expired leases of e, r.mutex must be held
+func (r *Registry) expire(service string, e *entry) {
+	now := time.Now()
+	expired := false
+	for address, expiry := range e.leases {
+		if !now.Before(expiry) {
+			delete(e.leases, address)
+			expired = true
+		}
+	}
+	if expired {
+		r.notify(e)
+		r.drop(service, e)
+	}
+}
+
+// nextExpiry returns the earliest expiry of the leases of e, r.mutex must be held
+func (r *Registry) nextExpiry(e *entry) time.Time {
+	var next time.Time
+	for _, expiry := range e.leases {
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	return next
+}
+
+// notify gives e a new revision and wakes up its watchers.
+// Revisions are counted across services, so a service registered
+// again never repeats the revision of its previous entry.
+func (r *Registry) notify(e *entry) {
+	r.revision++
+	e.revision = r.revision
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// addresses returns the sorted addresses of e
+func (e *entry) addresses(service string) *Addresses {
+	addresses := make([]string, 0, len(e.leases))
+	for address := range e.leases {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return &Addresses{Service: service, Revision: e.revision, Addresses: addresses}
+}
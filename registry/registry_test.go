@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sunlidea/ferry/server"
+	"net"
+	"testing"
+	"time"
+)
+
+// startRegistry serves a registry on a local listener
+func startRegistry(t *testing.T) (*Registry, net.Listener) {
+	reg := New()
+	s := server.NewServer()
+	if err := s.Register(reg); err != nil {
+		t.Fatalf("startRegistry|Register|Fail|%v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("startRegistry|Listen|Fail|%v", err)
+	}
+	go s.Serve(l)
+	return reg, l
+}
+
+// next waits for the next set of addresses
+func next(t *testing.T, ch <-chan []string) []string {
+	select {
+	case addresses := <-ch:
+		return addresses
+	case <-time.After(5 * time.Second):
+		t.Fatalf("next|timeout")
+		return nil
+	}
+}
+
+// Test announcements show up in the resolver and go away on Close
+func TestAnnounce(t *testing.T) {
+	_, l := startRegistry(t)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	a1, err := Announce("tcp", addr, "Arith", "10.0.0.1:1234", time.Minute)
+	if err != nil {
+		t.Fatalf("TestAnnounce|Announce|Fail|%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := NewResolver("tcp", addr).Resolve(ctx, "Arith")
+	if err != nil {
+		t.Fatalf("TestAnnounce|Resolve|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"10.0.0.1:1234"}, next(t, ch)); diff != "" {
+		t.Fatalf("TestAnnounce|first|Fail|%s", diff)
+		return
+	}
+
+	a2, err := Announce("tcp", addr, "Arith", "10.0.0.2:1234", time.Minute)
+	if err != nil {
+		t.Fatalf("TestAnnounce|Announce|Fail|%v", err)
+		return
+	}
+	defer a2.Close()
+	if diff := cmp.Diff([]string{"10.0.0.1:1234", "10.0.0.2:1234"}, next(t, ch)); diff != "" {
+		t.Fatalf("TestAnnounce|added|Fail|%s", diff)
+		return
+	}
+
+	if err := a1.Close(); err != nil {
+		t.Fatalf("TestAnnounce|Close|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"10.0.0.2:1234"}, next(t, ch)); diff != "" {
+		t.Fatalf("TestAnnounce|removed|Fail|%s", diff)
+	}
+}
+
+// Test leases expire without heartbeats and are kept alive by them
+func TestRegistry_Expire(t *testing.T) {
+	reg := New()
+	ttl := 50 * time.Millisecond
+	reg.Register(&Lease{Service: "Arith", Address: "a:1", TTL: ttl})
+	reg.Register(&Lease{Service: "Arith", Address: "b:1", TTL: ttl})
+
+	current, _ := reg.Lookup("Arith")
+	stop := time.After(4 * ttl)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(ttl / 3):
+				reg.Renew(&Lease{Service: "Arith", Address: "b:1", TTL: ttl})
+			}
+		}
+	}()
+
+	changed, err := reg.Watch(&WatchRequest{Service: "Arith", Revision: current.Revision, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("TestRegistry_Expire|Watch|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"b:1"}, changed.Addresses); diff != "" {
+		t.Fatalf("TestRegistry_Expire|expired|Fail|%s", diff)
+		return
+	}
+
+	time.Sleep(6 * ttl)
+	if ok, _ := reg.Renew(&Lease{Service: "Arith", Address: "b:1", TTL: ttl}); ok {
+		t.Fatalf("TestRegistry_Expire|Renew|expired lease renewed")
+	}
+}
+
+// Test only registrations create entries
+func TestRegistry_Unknown(t *testing.T) {
+	reg := New()
+	reg.Lookup("a")
+	reg.Renew(&Lease{Service: "b", Address: "b:1", TTL: time.Minute})
+	reg.Deregister(&Lease{Service: "c", Address: "c:1"})
+	reg.Watch(&WatchRequest{Service: "d", Timeout: time.Millisecond})
+	if len(reg.services) != 0 {
+		t.Fatalf("TestRegistry_Unknown|entries|Fail|%d", len(reg.services))
+		return
+	}
+
+	// a watcher of an unknown service sees its first registration
+	done := make(chan *Addresses, 1)
+	go func() {
+		addresses, _ := reg.Watch(&WatchRequest{Service: "e", Timeout: time.Second})
+		done <- addresses
+	}()
+	time.Sleep(10 * time.Millisecond)
+	reg.Register(&Lease{Service: "e", Address: "e:1", TTL: time.Minute})
+	if addresses := <-done; len(addresses.Addresses) != 1 {
+		t.Fatalf("TestRegistry_Unknown|Watch|Fail|%+v", addresses)
+		return
+	}
+
+	reg.Deregister(&Lease{Service: "e", Address: "e:1"})
+	if len(reg.services) != 0 {
+		t.Fatalf("TestRegistry_Unknown|drop|Fail|%d", len(reg.services))
+		return
+	}
+
+	if _, err := Announce("tcp", "127.0.0.1:1", "e", "e:1", 2*time.Nanosecond); err == nil {
+		t.Fatalf("TestRegistry_Unknown|Announce|Fail|short TTL accepted")
+	}
+}
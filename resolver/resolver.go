@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Resolver finds the addresses serving a service
+type Resolver interface {
+	// Resolve streams the addresses of the service: the current set first,
+	// then the new set every time it changes. The channel is closed once
+	// ctx is done.
+	Resolve(ctx context.Context, service string) (<-chan []string, error)
+}
+
+// Static resolves services from a fixed table
+type Static map[string][]string
+
+// Resolve sends the addresses of the service once
+func (s Static) Resolve(ctx context.Context, service string) (<-chan []string, error) {
+	addresses, ok := s[service]
+	if !ok {
+		return nil, fmt.Errorf("resolver: unknown service %s", service)
+	}
+	ch := make(chan []string, 1)
+	ch <- append([]string(nil), addresses...)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// File resolves services from a JSON file mapping each service
+// to its addresses, such as {"Arith": ["10.0.0.1:1234", "10.0.0.2:1234"]}.
+// The file is polled and read again when its modification time or size changes.
+type File struct {
+	Path     string
+	Interval time.Duration // polling interval, 0 means 1s
+}
+
+// NewFile returns a resolver polling the file at path
+func NewFile(path string, interval time.Duration) *File {
+	return &File{Path: path, Interval: interval}
+}
+
+// Resolve reads the file and sends the addresses of the service
+// every time they change
+func (f *File) Resolve(ctx context.Context, service string) (<-chan []string, error) {
+	info, table, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	interval := f.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	current := normalize(table[service])
+	ch := make(chan []string, 1)
+	ch <- current
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			stat, err := os.Stat(f.Path)
+			if err != nil {
+				log.Print("resolver.File: Stat Fail: ", err.Error())
+				continue
+			}
+			if stat.ModTime().Equal(info.ModTime()) && stat.Size() == info.Size() {
+				continue
+			}
+			newInfo, newTable, err := f.read()
+			if err != nil {
+				// keep the last good addresses, the file may be half written
+				log.Print("resolver.File: read Fail: ", err.Error())
+				continue
+			}
+			info = newInfo
+			addresses := normalize(newTable[service])
+			if equal(addresses, current) {
+				continue
+			}
+			current = addresses
+			select {
+			case ch <- addresses:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// read loads the table of the file
+func (f *File) read() (os.FileInfo, map[string][]string, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var table map[string][]string
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, nil, fmt.Errorf("resolver: %s: %v", f.Path, err)
+	}
+	return info, table, nil
+}
+
+// normalize returns a sorted copy of the addresses without duplicates
+func normalize(addresses []string) []string {
+	sorted := append([]string(nil), addresses...)
+	sort.Strings(sorted)
+	out := sorted[:0]
+	for i, address := range sorted {
+		if i == 0 || address != sorted[i-1] {
+			out = append(out, address)
+		}
+	}
+	return out
+}
+
+// equal reports whether two normalized address sets are the same
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package resolver
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test the static resolver
+func TestStatic_Resolve(t *testing.T) {
+	r := Static{"Arith": {"127.0.0.1:1234"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Resolve(ctx, "Arith")
+	if err != nil {
+		t.Fatalf("TestStatic_Resolve|Resolve|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1:1234"}, <-ch); diff != "" {
+		t.Fatalf("TestStatic_Resolve|addresses|Fail|%s", diff)
+		return
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("TestStatic_Resolve|close|Fail")
+		return
+	}
+
+	if _, err := r.Resolve(context.Background(), "Missing"); err == nil {
+		t.Fatalf("TestStatic_Resolve|unknown service resolved")
+	}
+}
+
+// Test the file resolver follows changes of the file
+func TestFile_Resolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("TestFile_Resolve|WriteFile|Fail|%v", err)
+		}
+	}
+	write(`{"Arith": ["b:1", "a:1", "a:1"], "Other": ["c:1"]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := NewFile(path, 5*time.Millisecond).Resolve(ctx, "Arith")
+	if err != nil {
+		t.Fatalf("TestFile_Resolve|Resolve|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"a:1", "b:1"}, <-ch); diff != "" {
+		t.Fatalf("TestFile_Resolve|addresses|Fail|%s", diff)
+		return
+	}
+
+	// a change of another service isn't sent, a broken file is skipped
+	write(`{"Arith": ["a:1", "b:1"], "Other": ["c:1", "d:1"]}`)
+	time.Sleep(20 * time.Millisecond)
+	write(`{"Arith": [`)
+	time.Sleep(20 * time.Millisecond)
+	write(`{"Arith": ["c:1"]}`)
+
+	select {
+	case addresses := <-ch:
+		if diff := cmp.Diff([]string{"c:1"}, addresses); diff != "" {
+			t.Fatalf("TestFile_Resolve|update|Fail|%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestFile_Resolve|update|timeout")
+	}
+}
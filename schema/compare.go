@@ -0,0 +1,195 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Change is a difference between two versions of a schema
+type Change struct {
+	Breaking bool   // clients of the old version may fail against the new one
+	Path     string // service, method, type or field that changed
+	Message  string
+}
+
+func (c Change) String() string {
+	if c.Breaking {
+		return "BREAKING " + c.Path + ": " + c.Message
+	}
+	return c.Path + ": " + c.Message
+}
+
+// Breaking reports whether changes has a breaking change
+func Breaking(changes []Change) bool {
+	for _, c := range changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// comparer compares the types of two schemas
+type comparer struct {
+	old, new *Schema
+	changes  []Change
+	visited  map[[2]string]bool // pairs of struct types already compared
+}
+
+func (c *comparer) report(breaking bool, path, format string, args ...interface{}) {
+	c.changes = append(c.changes, Change{Breaking: breaking, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Compare returns the changes from old to new. Removed services and
+// methods, changed numbers of arguments or replys, retyped arguments,
+// replys and fields, removed fields and renamed JSON keys are breaking;
+// additions are not. Fields are matched by ferry number, then by Go name,
+// then by JSON key.
+func Compare(old, new *Schema) []Change {
+	c := &comparer{old: old, new: new, visited: make(map[[2]string]bool)}
+	for _, osvc := range old.Services {
+		nsvc := new.Service(osvc.Name)
+		if nsvc == nil {
+			c.report(true, osvc.Name, "service removed")
+			continue
+		}
+		for _, om := range osvc.Methods {
+			path := osvc.Name + "." + om.Name
+			nm := nsvc.Method(om.Name)
+			if nm == nil {
+				c.report(true, path, "method removed")
+				continue
+			}
+			c.compareList(path, "argument", om.Args, nm.Args)
+			c.compareList(path, "reply", om.Replys, nm.Replys)
+		}
+		for _, nm := range nsvc.Methods {
+			if osvc.Method(nm.Name) == nil {
+				c.report(false, osvc.Name+"."+nm.Name, "method added")
+			}
+		}
+	}
+	for _, nsvc := range new.Services {
+		if old.Service(nsvc.Name) == nil {
+			c.report(false, nsvc.Name, "service added")
+		}
+	}
+	return c.changes
+}
+
+// compareList compares the arguments or replys of a method
+func (c *comparer) compareList(path, what string, old, new []string) {
+	if len(old) != len(new) {
+		c.report(true, path, "%s count changed from %d to %d", what, len(old), len(new))
+		return
+	}
+	for i := range old {
+		c.compareType(fmt.Sprintf("%s %s %d", path, what, i), old[i], new[i])
+	}
+}
+
+// compareType compares two type expressions, and the structs they use
+func (c *comparer) compareType(path, old, new string) {
+	ot, nt := c.old.Types[old], c.new.Types[new]
+	switch {
+	case ot != nil && nt != nil:
+		// structs may be renamed, their fields are what's on the wire
+		c.compareStruct(old, new, ot, nt)
+		return
+	case ot == nil && nt == nil:
+		if oe, ne, ok := elems(old, new); ok {
+			for i := range oe {
+				c.compareType(path, oe[i], ne[i])
+			}
+			return
+		}
+		if old == new {
+			return
+		}
+	}
+	c.report(true, path, "type changed from %s to %s", old, new)
+}
+
+// elems splits list and map types of the same shape in their key and element types
+func elems(old, new string) ([]string, []string, bool) {
+	if strings.HasPrefix(old, "[]") && strings.HasPrefix(new, "[]") {
+		return []string{old[2:]}, []string{new[2:]}, true
+	}
+	oldKey, oldElem := splitMap(old)
+	newKey, newElem := splitMap(new)
+	if oldKey == "" || newKey == "" {
+		return nil, nil, false
+	}
+	return []string{oldKey, oldElem}, []string{newKey, newElem}, true
+}
+
+// splitMap returns the key and element types of a map type, "" if t isn't a map
+func splitMap(t string) (string, string) {
+	if !strings.HasPrefix(t, "map[") {
+		return "", ""
+	}
+	depth := 0
+	for i := 3; i < len(t); i++ {
+		switch t[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return t[4:i], t[i+1:]
+			}
+		}
+	}
+	return "", ""
+}
+
+// compareStruct compares the fields of two struct types
+func (c *comparer) compareStruct(oldName, newName string, old, new *Type) {
+	key := [2]string{oldName, newName}
+	if c.visited[key] {
+		return
+	}
+	c.visited[key] = true
+
+	matched := make(map[*Field]bool)
+	for _, of := range old.Fields {
+		path := oldName + "." + of.Name
+		nf := matchField(of, new.Fields)
+		if nf == nil {
+			c.report(true, path, "field removed")
+			continue
+		}
+		matched[nf] = true
+		if of.JSON != nf.JSON {
+			c.report(true, path, "JSON key renamed from %q to %q", of.JSON, nf.JSON)
+		}
+		c.compareType(path, of.Type, nf.Type)
+	}
+	for _, nf := range new.Fields {
+		if !matched[nf] {
+			c.report(false, newName+"."+nf.Name, "field added")
+		}
+	}
+}
+
+// matchField returns the field of fields matching f, or nil
+func matchField(f *Field, fields []*Field) *Field {
+	if f.Number != 0 {
+		for _, nf := range fields {
+			if nf.Number == f.Number {
+				return nf
+			}
+		}
+	}
+	for _, nf := range fields {
+		if nf.Name == f.Name {
+			return nf
+		}
+	}
+	for _, nf := range fields {
+		if nf.JSON == f.JSON {
+			return nf
+		}
+	}
+	return nil
+}
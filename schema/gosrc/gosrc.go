@@ -0,0 +1,224 @@
+// Package gosrc describes the services of Go packages from their source,
+// as package schema does from a running server. It type checks the code,
+// so it's kept apart from schema, which servers link.
+package gosrc
+
+import (
+	"fmt"
+	"github.com/sunlidea/ferry/schema"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// LoadPackage parses and type checks the Go package in dir
+func LoadPackage(dir string) (*types.Package, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := importPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(bp.GoFiles))
+	for _, name := range bp.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	// the package may use code about to be generated, type errors are
+	// tolerated as long as the signatures of the handlers are complete
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(err error) {},
+	}
+	pkg, _ := conf.Check(path, fset, files, nil)
+	return pkg, nil
+}
+
+// importPath returns the import path of the package in dir
+func importPath(dir string) (string, error) {
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}}", ".")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go list %s: %v", dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// FromPackage describes the named types of pkg as services, or every
+// exported type with methods servable by Server.Register if names is empty.
+// Types may be handlers or interfaces, such as those written by ferrygen.
+func FromPackage(pkg *types.Package, names ...string) (*schema.Schema, error) {
+	s := schema.New()
+	all := len(names) == 0
+	if all {
+		names = pkg.Scope().Names()
+	}
+	for _, name := range names {
+		obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok {
+			if all {
+				continue
+			}
+			return nil, fmt.Errorf("type %s not found in %s", name, pkg.Path())
+		}
+		if all && !obj.Exported() {
+			continue
+		}
+
+		var methods []*types.Func
+		if it, ok := obj.Type().Underlying().(*types.Interface); ok {
+			for i := 0; i < it.NumMethods(); i++ {
+				methods = append(methods, it.Method(i))
+			}
+		} else {
+			mset := types.NewMethodSet(types.NewPointer(obj.Type()))
+			for i := 0; i < mset.Len(); i++ {
+				methods = append(methods, mset.At(i).Obj().(*types.Func))
+			}
+		}
+		n := 0
+		for _, fn := range methods {
+			if !fn.Exported() {
+				continue
+			}
+			if m := typesMethod(s, fn); m != nil {
+				s.Add(name, m)
+				n++
+			}
+		}
+		if n == 0 && !all {
+			return nil, fmt.Errorf("type %s has no methods to serve", name)
+		}
+	}
+	return s, nil
+}
+
+// typesMethod describes fn, or returns nil if it can't be served
+func typesMethod(s *schema.Schema, fn *types.Func) *schema.Method {
+	sig := fn.Type().(*types.Signature)
+	results := sig.Results()
+	if sig.Variadic() || results.Len() == 0 || !isError(results.At(results.Len()-1).Type()) {
+		return nil
+	}
+	m := &schema.Method{Name: fn.Name(), Args: []string{}, Replys: []string{}}
+	params := sig.Params()
+	for i := 0; i < params.Len(); i++ {
+		if i == 0 && isContext(params.At(i).Type()) {
+			continue
+		}
+		m.Args = append(m.Args, typesType(s, params.At(i).Type()))
+	}
+	for i := 0; i < results.Len()-1; i++ {
+		m.Replys = append(m.Replys, typesType(s, results.At(i).Type()))
+	}
+	return m
+}
+
+// typesType returns the type expression of t, as Schema.AddMethod does for
+// reflect types
+func typesType(s *schema.Schema, t types.Type) string {
+	for {
+		p, ok := t.(*types.Pointer)
+		if !ok || marshals(t) {
+			break
+		}
+		t = p.Elem()
+	}
+	if marshals(t) {
+		// encodes itself
+		return types.TypeString(t, func(pkg *types.Package) string { return pkg.Name() })
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		return types.Typ[u.Kind()].Name()
+	case *types.Slice:
+		if b, ok := u.Elem().Underlying().(*types.Basic); ok && b.Kind() == types.Uint8 {
+			return "bytes"
+		}
+		return "[]" + typesType(s, u.Elem())
+	case *types.Array:
+		return "[]" + typesType(s, u.Elem())
+	case *types.Map:
+		return "map[" + typesType(s, u.Key()) + "]" + typesType(s, u.Elem())
+	case *types.Interface:
+		return "any"
+	case *types.Struct:
+		// named structs are keyed by import path and name
+		name := types.TypeString(t, nil)
+		if _, ok := s.Types[name]; !ok {
+			typ := &schema.Type{Fields: []*schema.Field{}}
+			s.Types[name] = typ
+			typesFields(s, typ, u)
+		}
+		return name
+	}
+	return t.String()
+}
+
+// typesFields describes the fields of the struct u encoded by encoding/json
+func typesFields(s *schema.Schema, typ *schema.Type, u *types.Struct) {
+	for i := 0; i < u.NumFields(); i++ {
+		f := u.Field(i)
+		tag := reflect.StructTag(u.Tag(i))
+		if !f.Exported() && !f.Embedded() {
+			continue
+		}
+		key, ok := schema.JSONKey(f.Name(), tag.Get("json"))
+		if !ok {
+			continue
+		}
+		ft := f.Type()
+		if p, ok := ft.(*types.Pointer); ok {
+			ft = p.Elem()
+		}
+		if st, ok := ft.Underlying().(*types.Struct); ok && f.Embedded() && key == f.Name() {
+			// fields of embedded structs without a json name are promoted
+			typesFields(s, typ, st)
+			continue
+		}
+		if !f.Exported() {
+			continue
+		}
+		number, _ := strconv.Atoi(tag.Get("ferryfield"))
+		typ.Fields = append(typ.Fields, &schema.Field{Name: f.Name(), JSON: key, Type: typesType(s, f.Type()), Number: number})
+	}
+}
+
+func isError(t types.Type) bool {
+	return types.Implements(t, types.Universe.Lookup("error").Type().Underlying().(*types.Interface))
+}
+
+func isContext(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "context" && obj.Name() == "Context"
+}
+
+// marshals reports whether t (or a pointer to it) encodes itself in JSON or text
+func marshals(t types.Type) bool {
+	if _, ok := t.(*types.Pointer); !ok {
+		t = types.NewPointer(t)
+	}
+	mset := types.NewMethodSet(t)
+	return mset.Lookup(nil, "MarshalJSON") != nil || mset.Lookup(nil, "MarshalText") != nil
+}
@@ -0,0 +1,123 @@
+package gosrc
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sunlidea/ferry/schema"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Meta struct {
+	Tags map[string][]string
+}
+
+type Level int
+
+type Item struct {
+	Meta
+	Name    string    `json:"name" ferryfield:"1"`
+	Price   *int64    `json:"price,omitempty" ferryfield:"2"`
+	Level   Level     `ferryfield:"3"`
+	Data    []byte    `json:"data"`
+	Added   time.Time `json:"added"`
+	Next    *Item     `json:"next"`
+	Extra   interface{}
+	Skipped string `json:"-"`
+	hidden  string
+}
+
+type Cart struct{}
+
+func (c *Cart) Add(ctx context.Context, item *Item, n int) (int, error) { return n, nil }
+
+func (c *Cart) Items() ([]Item, error) { return nil, nil }
+
+// cartSource declares Cart in Go source, as seen by FromPackage
+const cartSource = `package gosrc
+
+import (
+	"context"
+	"time"
+)
+
+type Meta struct {
+	Tags map[string][]string
+}
+
+type Level int
+
+type Item struct {
+	Meta
+	Name    string    ` + "`json:\"name\" ferryfield:\"1\"`" + `
+	Price   *int64    ` + "`json:\"price,omitempty\" ferryfield:\"2\"`" + `
+	Level   Level     ` + "`ferryfield:\"3\"`" + `
+	Data    []byte    ` + "`json:\"data\"`" + `
+	Added   time.Time ` + "`json:\"added\"`" + `
+	Next    *Item     ` + "`json:\"next\"`" + `
+	Extra   interface{}
+	Skipped string ` + "`json:\"-\"`" + `
+	hidden  string
+}
+
+type Cart interface {
+	Add(ctx context.Context, item *Item, n int) (int, error)
+	Items() ([]Item, error)
+}
+`
+
+// cartSchema returns the schema of Cart built by reflection
+func cartSchema() *schema.Schema {
+	s := schema.New()
+	typ := reflect.TypeOf(new(Cart))
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		var args []reflect.Type
+		for j := 1; j < m.Type.NumIn(); j++ {
+			if j == 1 && m.Type.In(j) == reflect.TypeOf((*context.Context)(nil)).Elem() {
+				continue
+			}
+			args = append(args, m.Type.In(j))
+		}
+		var replys []reflect.Type
+		for j := 0; j < m.Type.NumOut(); j++ {
+			replys = append(replys, m.Type.Out(j))
+		}
+		s.AddMethod("Cart", m.Name, args, replys)
+	}
+	return s
+}
+
+// Test Go packages and reflection describe the same types alike
+func TestFromPackage(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "cart.go", cartSource, 0)
+	if err != nil {
+		t.Fatalf("TestFromPackage|ParseFile|Fail|%v", err)
+		return
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check(reflect.TypeOf(Item{}).PkgPath(), fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatalf("TestFromPackage|Check|Fail|%v", err)
+		return
+	}
+
+	s, err := FromPackage(pkg)
+	if err != nil {
+		t.Fatalf("TestFromPackage|FromPackage|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff(cartSchema(), s); diff != "" {
+		t.Fatalf("TestFromPackage|Fail|%s", diff)
+	}
+	if _, err := FromPackage(pkg, "Item"); err == nil {
+		t.Fatalf("TestFromPackage|Item|Fail|no error")
+	}
+}
@@ -0,0 +1,265 @@
+// Package schema describes the services of a ferry API the way they look on
+// the wire, and compares versions of a description to find breaking changes.
+//
+// Descriptions are built from a running server (Server.Describe and the
+// reflection service), from .ferry files or, with package gosrc, from Go
+// packages. Types are written as JSON sees them: pointers are dropped, named
+// basic types are replaced by their kind, []byte is "bytes" and structs are
+// referred to by import path and name, such as example.com/shop.Item, or by
+// message name, and listed in Schema.Types.
+package schema
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/sunlidea/ferry/idl"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReflectionService is the name of the service describing a server,
+// published by Server.RegisterReflection
+const ReflectionService = "ferry.Reflection"
+
+// ReflectionProxy is the client definition of the reflection service
+type ReflectionProxy struct {
+	List     func() ([]string, error)
+	Describe func(services []string) (*Schema, error)
+}
+
+// Schema describes services and the struct types they use
+type Schema struct {
+	Services []*Service       `json:"services"`
+	Types    map[string]*Type `json:"types,omitempty"`
+}
+
+// Service describes a service
+type Service struct {
+	Name    string    `json:"name"`
+	Methods []*Method `json:"methods"`
+}
+
+// Method describes a method, its replys don't include the trailing error
+type Method struct {
+	Name   string   `json:"name"`
+	Args   []string `json:"args"`
+	Replys []string `json:"replys"`
+}
+
+// Type describes a struct type
+type Type struct {
+	Fields []*Field `json:"fields"`
+}
+
+// Field describes a field of a struct type
+type Field struct {
+	Name   string `json:"name"`             // Go name
+	JSON   string `json:"json"`             // key in JSON objects
+	Type   string `json:"type"`             // type of the field
+	Number int    `json:"number,omitempty"` // number of the ferryfield tag, 0 without
+}
+
+// New returns an empty schema
+func New() *Schema {
+	return &Schema{Types: make(map[string]*Type)}
+}
+
+// Service returns the service named name, or nil
+func (s *Schema) Service(name string) *Service {
+	for _, svc := range s.Services {
+		if svc.Name == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// Method returns the method named name, or nil
+func (s *Service) Method(name string) *Method {
+	for _, m := range s.Methods {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Add adds a method to the service named serviceName, creating it if needed
+func (s *Schema) Add(serviceName string, m *Method) {
+	s.addMethod(serviceName, m)
+	s.sort()
+}
+
+// addMethod adds a method to the service named serviceName, creating it if needed
+func (s *Schema) addMethod(serviceName string, m *Method) {
+	svc := s.Service(serviceName)
+	if svc == nil {
+		svc = &Service{Name: serviceName}
+		s.Services = append(s.Services, svc)
+	}
+	svc.Methods = append(svc.Methods, m)
+}
+
+// sort orders the services and methods by name
+func (s *Schema) sort() {
+	sort.Slice(s.Services, func(i, j int) bool { return s.Services[i].Name < s.Services[j].Name })
+	for _, svc := range s.Services {
+		sort.Slice(svc.Methods, func(i, j int) bool { return svc.Methods[i].Name < svc.Methods[j].Name })
+	}
+}
+
+var (
+	typeOfJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// AddMethod describes a method of a service from its argument and reply
+// types, a trailing error reply is ignored
+func (s *Schema) AddMethod(serviceName, methodName string, args, replys []reflect.Type) {
+	m := &Method{Name: methodName, Args: []string{}, Replys: []string{}}
+	for _, t := range args {
+		m.Args = append(m.Args, s.typeOf(t))
+	}
+	for i, t := range replys {
+		if i == len(replys)-1 && t == reflect.TypeOf((*error)(nil)).Elem() {
+			break
+		}
+		m.Replys = append(m.Replys, s.typeOf(t))
+	}
+	s.addMethod(serviceName, m)
+	s.sort()
+}
+
+// typeOf returns the type expression of t, describing the structs it uses
+func (s *Schema) typeOf(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		if t.Implements(typeOfJSONMarshaler) || t.Implements(typeOfTextMarshaler) {
+			break
+		}
+		t = t.Elem()
+	}
+	if t.Implements(typeOfJSONMarshaler) || t.Implements(typeOfTextMarshaler) ||
+		reflect.PtrTo(t).Implements(typeOfJSONMarshaler) || reflect.PtrTo(t).Implements(typeOfTextMarshaler) {
+		// encodes itself
+		return strings.TrimPrefix(t.String(), "*")
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "[]" + s.typeOf(t.Elem())
+	case reflect.Map:
+		return "map[" + s.typeOf(t.Key()) + "]" + s.typeOf(t.Elem())
+	case reflect.Interface:
+		return "any"
+	case reflect.Struct:
+		// structs of different packages may share a name
+		name := t.String()
+		if t.Name() != "" && t.PkgPath() != "" {
+			name = t.PkgPath() + "." + t.Name()
+		}
+		if _, ok := s.Types[name]; !ok {
+			typ := &Type{Fields: []*Field{}}
+			s.Types[name] = typ
+			s.addFields(typ, t)
+		}
+		return name
+	}
+	return t.Kind().String()
+}
+
+// addFields describes the fields of the struct t encoded by encoding/json
+func (s *Schema) addFields(typ *Type, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		key, ok := JSONKey(f.Name, f.Tag.Get("json"))
+		if !ok {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && key == f.Name {
+			// fields of embedded structs without a json name are promoted
+			s.addFields(typ, ft)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		number, _ := strconv.Atoi(f.Tag.Get("ferryfield"))
+		typ.Fields = append(typ.Fields, &Field{Name: f.Name, JSON: key, Type: s.typeOf(f.Type), Number: number})
+	}
+}
+
+// JSONKey returns the JSON key of a field from its json tag,
+// false if the field isn't encoded
+func JSONKey(name, tag string) (string, bool) {
+	if tag == "-" {
+		return "", false
+	}
+	if key, _, _ := strings.Cut(tag, ","); key != "" {
+		return key, true
+	}
+	return name, true
+}
+
+// FromIDL describes the services and messages of a .ferry file
+func FromIDL(f *idl.File) *Schema {
+	s := New()
+	for _, m := range f.Messages {
+		typ := &Type{Fields: []*Field{}}
+		for _, field := range m.Fields {
+			typ.Fields = append(typ.Fields, &Field{
+				Name:   field.Name,
+				JSON:   field.Name,
+				Type:   idlType(field.Type),
+				Number: field.Number,
+			})
+		}
+		s.Types[m.Name] = typ
+	}
+	for _, svc := range f.Services {
+		for _, m := range svc.Methods {
+			method := &Method{Name: m.Name, Args: []string{}, Replys: []string{}}
+			if m.Request != nil {
+				method.Args = append(method.Args, idlType(m.Request))
+			}
+			if m.Response != nil {
+				method.Replys = append(method.Replys, idlType(m.Response))
+			}
+			s.addMethod(svc.Name, method)
+		}
+	}
+	s.sort()
+	return s
+}
+
+// idlType returns the type expression of a .ferry type
+func idlType(t *idl.Type) string {
+	switch t.Kind {
+	case idl.Repeated:
+		return "[]" + idlType(t.Elem)
+	case idl.Map:
+		return "map[" + idlType(t.Key) + "]" + idlType(t.Elem)
+	}
+	return t.Name
+}
+
+// String returns the schema as indented JSON
+func (s *Schema) String() string {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Sprintf("schema: %v", err)
+	}
+	return string(data)
+}
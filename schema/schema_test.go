@@ -0,0 +1,192 @@
+package schema
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sunlidea/ferry/idl"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Meta struct {
+	Tags map[string][]string
+}
+
+type Level int
+
+type Item struct {
+	Meta
+	Name    string    `json:"name" ferryfield:"1"`
+	Price   *int64    `json:"price,omitempty" ferryfield:"2"`
+	Level   Level     `ferryfield:"3"`
+	Data    []byte    `json:"data"`
+	Added   time.Time `json:"added"`
+	Next    *Item     `json:"next"`
+	Extra   interface{}
+	Skipped string `json:"-"`
+	hidden  string
+}
+
+type Cart struct{}
+
+// itemName is the name of Item in schemas
+const itemName = "github.com/sunlidea/ferry/schema.Item"
+
+func (c *Cart) Add(ctx context.Context, item *Item, n int) (int, error) { return n, nil }
+
+func (c *Cart) Items() ([]Item, error) { return nil, nil }
+
+// cartSchema returns the schema of Cart built by reflection
+func cartSchema() *Schema {
+	s := New()
+	typ := reflect.TypeOf(new(Cart))
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		var args, replys []reflect.Type
+		for j := 1; j < m.Type.NumIn(); j++ {
+			if j == 1 && m.Type.In(j) == reflect.TypeOf((*context.Context)(nil)).Elem() {
+				continue
+			}
+			args = append(args, m.Type.In(j))
+		}
+		for j := 0; j < m.Type.NumOut(); j++ {
+			replys = append(replys, m.Type.Out(j))
+		}
+		s.AddMethod("Cart", m.Name, args, replys)
+	}
+	return s
+}
+
+// Test the schema of types described by reflection
+func TestAddMethod(t *testing.T) {
+	s := cartSchema()
+	want := []*Method{
+		{Name: "Add", Args: []string{itemName, "int"}, Replys: []string{"int"}},
+		{Name: "Items", Args: []string{}, Replys: []string{"[]" + itemName}},
+	}
+	if diff := cmp.Diff(want, s.Service("Cart").Methods); diff != "" {
+		t.Fatalf("TestAddMethod|methods|Fail|%s", diff)
+	}
+
+	item := &Type{Fields: []*Field{
+		{Name: "Tags", JSON: "Tags", Type: "map[string][]string"},
+		{Name: "Name", JSON: "name", Type: "string", Number: 1},
+		{Name: "Price", JSON: "price", Type: "int64", Number: 2},
+		{Name: "Level", JSON: "Level", Type: "int", Number: 3},
+		{Name: "Data", JSON: "data", Type: "bytes"},
+		{Name: "Added", JSON: "added", Type: "time.Time"},
+		{Name: "Next", JSON: "next", Type: itemName},
+		{Name: "Extra", JSON: "Extra", Type: "any"},
+	}}
+	if diff := cmp.Diff(map[string]*Type{itemName: item}, s.Types); diff != "" {
+		t.Fatalf("TestAddMethod|types|Fail|%s", diff)
+	}
+}
+
+// Test the schema of a .ferry file
+func TestFromIDL(t *testing.T) {
+	f, err := idl.Parse("shop.ferry", []byte(`
+message Item {
+	string name = 1;
+	repeated int64 prices = 2;
+}
+
+service Shop {
+	rpc Get(string) returns (Item);
+	rpc Reset() returns ();
+}
+`))
+	if err != nil {
+		t.Fatalf("TestFromIDL|Parse|Fail|%v", err)
+		return
+	}
+	want := &Schema{
+		Services: []*Service{{Name: "Shop", Methods: []*Method{
+			{Name: "Get", Args: []string{"string"}, Replys: []string{"Item"}},
+			{Name: "Reset", Args: []string{}, Replys: []string{}},
+		}}},
+		Types: map[string]*Type{"Item": {Fields: []*Field{
+			{Name: "name", JSON: "name", Type: "string", Number: 1},
+			{Name: "prices", JSON: "prices", Type: "[]int64", Number: 2},
+		}}},
+	}
+	if diff := cmp.Diff(want, FromIDL(f)); diff != "" {
+		t.Fatalf("TestFromIDL|Fail|%s", diff)
+	}
+}
+
+// Test breaking and compatible changes are reported
+func TestCompare(t *testing.T) {
+	old := cartSchema()
+	if changes := Compare(old, cartSchema()); len(changes) != 0 {
+		t.Fatalf("TestCompare|same|Fail|%v", changes)
+		return
+	}
+
+	type Item struct {
+		Title string            `json:"title" ferryfield:"1"`
+		Price *string           `json:"price" ferryfield:"2"`
+		Level int               `ferryfield:"3"`
+		Data  []byte            `json:"data"`
+		Next  *Item             `json:"next"`
+		Tags  map[string]string `json:"tags"`
+	}
+	new := New()
+	typeOfItem := reflect.TypeOf(Item{})
+	typeOfInt := reflect.TypeOf(0)
+	typeOfError := reflect.TypeOf((*error)(nil)).Elem()
+	new.AddMethod("Cart", "Add", []reflect.Type{typeOfItem}, []reflect.Type{typeOfInt, typeOfError})
+	new.AddMethod("Cart", "Items", nil, []reflect.Type{reflect.SliceOf(typeOfItem), typeOfError})
+	new.AddMethod("Cart", "Clear", nil, []reflect.Type{typeOfError})
+	new.AddMethod("Orders", "List", nil, []reflect.Type{typeOfError})
+
+	var got []string
+	for _, c := range Compare(old, new) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"BREAKING Cart.Add: argument count changed from 2 to 1",
+		"BREAKING " + itemName + `.Tags: JSON key renamed from "Tags" to "tags"`,
+		"BREAKING " + itemName + ".Tags: type changed from []string to string",
+		"BREAKING " + itemName + `.Name: JSON key renamed from "name" to "title"`,
+		"BREAKING " + itemName + ".Price: type changed from int64 to string",
+		"BREAKING " + itemName + ".Added: field removed",
+		"BREAKING " + itemName + ".Extra: field removed",
+		"Cart.Clear: method added",
+		"Orders: service added",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("TestCompare|Fail|%s", diff)
+	}
+	if !Breaking(Compare(old, new)) || Breaking(Compare(old, old)) {
+		t.Fatalf("TestCompare|Breaking|Fail")
+	}
+	if !strings.HasPrefix(Compare(new, old)[0].String(), "BREAKING Cart.Add") {
+		t.Fatalf("TestCompare|reverse|Fail|%v", Compare(new, old))
+	}
+}
+
+type URL struct {
+	Raw string
+}
+
+// Test structs of different packages sharing a name are told apart
+func TestAddMethod_SameName(t *testing.T) {
+	s := New()
+	s.AddMethod("Links", "Resolve", []reflect.Type{reflect.TypeOf(URL{})}, []reflect.Type{reflect.TypeOf(url.URL{})})
+	want := &Method{
+		Name:   "Resolve",
+		Args:   []string{"github.com/sunlidea/ferry/schema.URL"},
+		Replys: []string{"net/url.URL"},
+	}
+	if diff := cmp.Diff(want, s.Service("Links").Method("Resolve")); diff != "" {
+		t.Fatalf("TestAddMethod_SameName|Fail|%s", diff)
+		return
+	}
+	if s.Types[want.Args[0]] == nil || s.Types[want.Replys[0]] == nil {
+		t.Fatalf("TestAddMethod_SameName|Types|Fail|%v", s)
+	}
+}
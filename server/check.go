@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	typeOfContext         = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfJSONMarshaler   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfJSONUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	typeOfTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// MethodError describes a method rejected at register time
+type MethodError struct {
+	Method string // name of the method
+	Reason string // why the method is not suitable
+}
+
+// RegisterError lists every method of a type rejected by Register
+type RegisterError struct {
+	Type    string        // the registered type
+	Methods []MethodError // rejected methods, in method order
+	Hint    string        // how to fix the registration, if known
+}
+
+func (e *RegisterError) Error() string {
+	var b strings.Builder
+	b.WriteString("rpc.Register: type ")
+	b.WriteString(e.Type)
+	b.WriteString(" has unsuitable methods")
+	if e.Hint != "" {
+		b.WriteString(" (hint: ")
+		b.WriteString(e.Hint)
+		b.WriteString(")")
+	}
+	b.WriteString(":")
+	for _, m := range e.Methods {
+		b.WriteString("\n\t")
+		b.WriteString(m.Method)
+		b.WriteString(": ")
+		b.WriteString(m.Reason)
+	}
+	return b.String()
+}
+
+// hasContext reports whether the first argument after skip is a context.Context
+func hasContext(mtype reflect.Type, skip int) bool {
+	return mtype.NumIn() > skip && mtype.In(skip) == typeOfContext
+}
+
+// checkMethod reports why a function of type mtype can't be served,
+// or "" if it can. The first skip input params (the receiver)
+// and a leading context.Context are ignored.
+func checkMethod(mtype reflect.Type, skip int) string {
+	if hasContext(mtype, skip) {
+		skip++
+	}
+	if mtype.IsVariadic() {
+		return "variadic arguments are not supported"
+	}
+	numOut := mtype.NumOut()
+	if numOut == 0 || !mtype.Out(numOut-1).Implements(typeOfError) {
+		// last return type must be error
+		return "last return type must be error"
+	}
+	for i := skip; i < mtype.NumIn(); i++ {
+		if reason := checkType(mtype.In(i), nil); reason != "" {
+			return fmt.Sprintf("argument %d: %s", i-skip, reason)
+		}
+	}
+	for i := 0; i < numOut-1; i++ {
+		if reason := checkType(mtype.Out(i), nil); reason != "" {
+			return fmt.Sprintf("reply %d: %s", i, reason)
+		}
+	}
+	return ""
+}
+
+// checkType reports why values of typ can't be carried by the JSON codec
+// used by the message package, or "" if they can.
+func checkType(typ reflect.Type, visited map[reflect.Type]bool) string {
+	if visited[typ] {
+		// recursive type, already being checked
+		return ""
+	}
+	if visited == nil {
+		visited = make(map[reflect.Type]bool)
+	}
+	visited[typ] = true
+
+	// types encoding themselves are trusted
+	if marshals(typ, typeOfJSONMarshaler, typeOfJSONUnmarshaler) ||
+		marshals(typ, typeOfTextMarshaler, typeOfTextUnmarshaler) {
+		return ""
+	}
+
+	switch typ.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer,
+		reflect.Complex64, reflect.Complex128:
+		return fmt.Sprintf("type %s is not serializable", typ)
+	case reflect.Interface:
+		if typ.NumMethod() > 0 {
+			return fmt.Sprintf("interface type %s has no concrete type to decode into", typ)
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkType(typ.Elem(), visited)
+	case reflect.Map:
+		switch typ.Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !marshals(typ.Key(), typeOfTextMarshaler, typeOfTextUnmarshaler) {
+				return fmt.Sprintf("map key type %s is not serializable", typ.Key())
+			}
+		}
+		return checkType(typ.Elem(), visited)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				// unexported fields are ignored by the codec
+				continue
+			}
+			if f.Tag.Get("json") == "-" {
+				continue
+			}
+			if reason := checkType(f.Type, visited); reason != "" {
+				return fmt.Sprintf("field %s.%s: %s", typ, f.Name, reason)
+			}
+		}
+	}
+	return ""
+}
+
+// marshals reports whether typ (or a pointer to it) implements
+// both the marshaler m and the unmarshaler u.
+func marshals(typ, m, u reflect.Type) bool {
+	ptr := typ
+	if typ.Kind() != reflect.Ptr {
+		ptr = reflect.PtrTo(typ)
+	}
+	return (typ.Implements(m) || ptr.Implements(m)) && ptr.Implements(u)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// connectHandler hands the connections of CONNECT and Upgrade: ferry
+// requests to ServeConn
+type connectHandler struct {
+	server *Server
+}
+
+// ConnectHandler returns a handler taking over the connections of HTTP
+// CONNECT requests and requests with an Upgrade: ferry header, to serve
+// them as ferry connections, see client.DialHTTP
+func ConnectHandler(s *Server) http.Handler {
+	return &connectHandler{server: s}
+}
+
+// HandleHTTP serves ferry connections on path of http.DefaultServeMux,
+// so ferry can share the port of an HTTP server
+func (s *Server) HandleHTTP(path string) {
+	http.Handle(path, ConnectHandler(s))
+}
+
+func (h *connectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp string
+	switch {
+	case r.Method == http.MethodConnect:
+		resp = "HTTP/1.0 200 Connected to ferry\r\n\r\n"
+	case strings.EqualFold(r.Header.Get("Upgrade"), "ferry"):
+		resp = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: ferry\r\nConnection: Upgrade\r\n\r\n"
+	default:
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "ferry.HandleHTTP: CONNECT or Upgrade: ferry required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "ferry.HandleHTTP: the connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Print("ferry.HandleHTTP: Hijack Fail: ", err.Error())
+		return
+	}
+	defer conn.Close()
+	// the deadlines of the HTTP server don't apply to the ferry connection
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		log.Print("ferry.HandleHTTP: Write Fail: ", err.Error())
+		return
+	}
+	h.server.ServeConn(&hijackedConn{Conn: conn, r: brw.Reader})
+}
+
+// hijackedConn reads the bytes the HTTP server buffered before the conn
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
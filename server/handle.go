@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sunlidea/ferry/message"
+	"log"
+	"reflect"
+)
+
+// handlerFunc decodes the raw arguments and runs a typed handler
+type handlerFunc func(ctx context.Context, args []json.RawMessage) ([]interface{}, error)
+
+// Handle publishes fn as the method of the named service. Unlike Register
+// and RegisterFunc, requests are dispatched to fn without reflect calls:
+// the single argument is decoded straight into a *Req.
+func Handle[Req, Resp any](s *Server, serviceName, methodName string,
+	fn func(context.Context, *Req) (*Resp, error)) error {
+	if err := checkNames(serviceName, methodName); err != nil {
+		return err
+	}
+
+	ftype := reflect.TypeOf(fn)
+	argType := reflect.TypeOf((*Req)(nil))
+	replyType := reflect.TypeOf((*Resp)(nil))
+	for _, typ := range []reflect.Type{argType, replyType} {
+		if reason := checkType(typ, nil); reason != "" {
+			err := &RegisterError{Type: ftype.String(), Methods: []MethodError{{Method: methodName, Reason: reason}}}
+			log.Print(err.Error())
+			return err
+		}
+	}
+
+	m := &methodType{
+		method:     reflect.Method{Name: methodName, Type: ftype},
+		ArgTypes:   []reflect.Type{argType},
+		ReplyTypes: []reflect.Type{replyType, typeOfError},
+		handler: func(ctx context.Context, args []json.RawMessage) ([]interface{}, error) {
+			req := new(Req)
+			if err := json.Unmarshal(args[0], req); err != nil {
+				return nil, message.Errorf(message.CodeInvalidRequest,
+					"ferry.handleRequest args 0 Unmarshal Fail:%v", err)
+			}
+			resp, err := fn(ctx, req)
+			return []interface{}{resp, err}, nil
+		},
+	}
+	return s.addMethod(serviceName, methodName, m)
+}
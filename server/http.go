@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/sunlidea/ferry/message"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// MaxHTTPBodySize is the largest request body accepted by HTTPHandler
+const MaxHTTPBodySize = 4 << 20
+
+// httpHandler serves the methods of a server over HTTP
+type httpHandler struct {
+	server *Server
+}
+
+// HTTPHandler returns a gateway serving the methods of s to HTTP clients.
+// A call is a POST to /{service}/{method} with the arguments as a JSON
+// array, the answer is a message.Response in JSON. The HTTP headers reach
+// methods taking a context.Context as Metadata, see MetadataFromContext.
+func HTTPHandler(s *Server) http.Handler {
+	return &httpHandler{server: s}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPResponse(w, http.StatusMethodNotAllowed, newResponse(nil, message.Errorf(message.CodeInvalidRequest,
+			"ferry.HTTPHandler: method %s not allowed", r.Method)))
+		return
+	}
+
+	// the service name may have slashes, the method is the last segment
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		writeHTTPResponse(w, http.StatusNotFound, newResponse(nil, message.Errorf(message.CodeMethodNotFound,
+			"ferry.HTTPHandler: path %s is not of the form /service/method", r.URL.Path)))
+		return
+	}
+	req := &message.RawRequest{Path: path[:slash], Method: path[slash+1:]}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxHTTPBodySize))
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, newResponse(nil, message.Errorf(message.CodeInvalidRequest,
+			"ferry.HTTPHandler: read body: %v", err)))
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &req.Args); err != nil {
+			writeHTTPResponse(w, http.StatusBadRequest, newResponse(nil, message.Errorf(message.CodeInvalidRequest,
+				"ferry.HTTPHandler: the body must be a JSON array of arguments: %v", err)))
+			return
+		}
+	}
+
+	ctx := WithMetadata(r.Context(), Metadata(r.Header.Clone()))
+	resp := newResponse(h.server.handleRequest(ctx, req))
+	if resp.Error != "" && resp.ErrCode != message.CodeApplication {
+		log.Print("ferry.HTTPHandler: handleRequest: ", resp.Error)
+	}
+	writeHTTPResponse(w, httpStatus(resp.ErrCode), resp)
+}
+
+// httpStatus returns the HTTP status of a response with the error code
+func httpStatus(code uint) int {
+	switch code {
+	case message.CodeOK:
+		return http.StatusOK
+	case message.CodeInvalidRequest:
+		return http.StatusBadRequest
+	case message.CodeServiceUnavailable, message.CodeMethodNotFound:
+		return http.StatusNotFound
+	}
+	// errors of the methods and of the server
+	return http.StatusInternalServerError
+}
+
+// writeHTTPResponse writes resp as JSON with the HTTP status
+func writeHTTPResponse(w http.ResponseWriter, status int, resp message.Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Print("ferry.HTTPHandler: Marshal: ", err.Error())
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(newResponse(nil, message.Errorf(message.CodeInternal,
+			"ferry.HTTPHandler: Marshal: %v", err)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sunlidea/ferry/message"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000 // the method returned an error
+)
+
+// jsonrpcRequest is a JSON-RPC 2.0 request, a notification has no id
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonrpcError is the error object of a JSON-RPC 2.0 response
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response, with either a result or an error
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var jsonrpcNull = json.RawMessage("null")
+
+// MaxJSONRPCCalls is the number of calls a JSON-RPC connection or HTTP
+// request runs at once, batch elements included
+const MaxJSONRPCCalls = 64
+
+func newJSONRPCError(id json.RawMessage, code int, msg string) *jsonrpcResponse {
+	if len(id) == 0 {
+		id = jsonrpcNull
+	}
+	return &jsonrpcResponse{Version: "2.0", Error: &jsonrpcError{Code: code, Message: msg}, ID: id}
+}
+
+// ServeJSONRPC accepts connections on the listener and serves the
+// JSON-RPC 2.0 requests of each, see ServeJSONRPCConn
+func (s *Server) ServeJSONRPC(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Print("ferry.ServeJSONRPC: accept:", err.Error())
+			return
+		}
+		go s.ServeJSONRPCConn(conn)
+	}
+}
+
+// ServeJSONRPCConn serves JSON-RPC 2.0 requests on conn, one request or
+// batch per line, until the client stops sending. "Service.Method" names the method, its params are the
+// arguments by position, or the single argument if they are an object.
+// Responses are written one per line as the calls complete. Lines longer
+// than MaxHTTPBodySize are answered with an invalid request error, and
+// reading waits while MaxJSONRPCCalls calls are running.
+func (s *Server) ServeJSONRPCConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, ReadSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var writeMu sync.Mutex
+	var inflight sync.WaitGroup
+	limit := make(chan struct{}, MaxJSONRPCCalls)
+
+	write := func(resp []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if _, err := conn.Write(append(resp, '\n')); err != nil {
+			log.Print("ferry.ServeJSONRPCConn: Write: ", err.Error())
+		}
+	}
+
+	for {
+		line, tooLong, err := readJSONRPCLine(r)
+		if tooLong {
+			write(encodeJSONRPC(newJSONRPCError(nil, jsonrpcInvalidRequest, "invalid request: line too long")))
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			limit <- struct{}{}
+			inflight.Add(1)
+			go func(line []byte) {
+				defer func() {
+					<-limit
+					inflight.Done()
+				}()
+				if resp := s.handleJSONRPC(ctx, line, limit); resp != nil {
+					write(resp)
+				}
+			}(line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Print("ferry.ServeJSONRPCConn: Read: ", err.Error())
+			}
+			// answer the requests read so far, clients may half close
+			inflight.Wait()
+			return
+		}
+	}
+}
+
+// readJSONRPCLine reads a line of at most MaxHTTPBodySize bytes, the rest
+// of a longer line is skipped and tooLong is set
+func readJSONRPCLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > MaxHTTPBodySize {
+				line, tooLong = nil, true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooLong, err
+		}
+	}
+}
+
+// JSONRPCHandler returns a handler serving the JSON-RPC 2.0 requests or
+// batches POSTed to it, as ServeJSONRPCConn does. The HTTP headers reach
+// the methods as Metadata.
+func JSONRPCHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "ferry.JSONRPCHandler: method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxHTTPBodySize))
+		if err != nil {
+			http.Error(w, "ferry.JSONRPCHandler: read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := WithMetadata(r.Context(), Metadata(r.Header.Clone()))
+		// the handler holds a slot
+		resp := s.handleJSONRPC(ctx, body, make(chan struct{}, MaxJSONRPCCalls-1))
+		if resp == nil {
+			// notifications only
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	})
+}
+
+// handleJSONRPC serves a request or a batch and returns the encoded
+// response, nil if there is nothing to answer. The caller holds a slot of
+// limit, batch elements run on the free ones or on the caller's.
+func (s *Server) handleJSONRPC(ctx context.Context, data []byte, limit chan struct{}) []byte {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return encodeJSONRPC(newJSONRPCError(nil, jsonrpcParseError, "parse error"))
+	}
+	if data[0] != '[' {
+		resp := s.callJSONRPC(ctx, data)
+		if resp == nil {
+			return nil
+		}
+		return encodeJSONRPC(resp)
+	}
+
+	// data is a valid JSON array
+	var batch []json.RawMessage
+	json.Unmarshal(data, &batch)
+	if len(batch) == 0 {
+		return encodeJSONRPC(newJSONRPCError(nil, jsonrpcInvalidRequest, "invalid request: empty batch"))
+	}
+	resps := make([]*jsonrpcResponse, len(batch))
+	var wg sync.WaitGroup
+	for i := range batch {
+		select {
+		case limit <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					<-limit
+					wg.Done()
+				}()
+				resps[i] = s.callJSONRPC(ctx, batch[i])
+			}(i)
+		default:
+			resps[i] = s.callJSONRPC(ctx, batch[i])
+		}
+	}
+	wg.Wait()
+
+	answers := make([]*jsonrpcResponse, 0, len(resps))
+	for _, resp := range resps {
+		if resp != nil {
+			answers = append(answers, resp)
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+	return encodeJSONRPC(answers)
+}
+
+// callJSONRPC serves a single request, it returns nil for notifications
+func (s *Server) callJSONRPC(ctx context.Context, data json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return newJSONRPCError(nil, jsonrpcInvalidRequest, "invalid request: "+err.Error())
+	}
+	if req.Version != "2.0" || req.Method == "" {
+		return newJSONRPCError(req.ID, jsonrpcInvalidRequest, `invalid request: jsonrpc must be "2.0" and method must be set`)
+	}
+	if !validJSONRPCID(req.ID) {
+		return newJSONRPCError(nil, jsonrpcInvalidRequest, "invalid request: id must be a string, a number or null")
+	}
+	notification := len(req.ID) == 0
+
+	resp := s.dispatchJSONRPC(ctx, &req)
+	if notification {
+		return nil
+	}
+	return resp
+}
+
+// dispatchJSONRPC calls the method of req through handleRequest
+func (s *Server) dispatchJSONRPC(ctx context.Context, req *jsonrpcRequest) *jsonrpcResponse {
+	dot := strings.LastIndex(req.Method, ".")
+	if dot <= 0 || dot == len(req.Method)-1 {
+		return newJSONRPCError(req.ID, jsonrpcMethodNotFound, "method not found: "+req.Method+" is not of the form Service.Method")
+	}
+	rawReq := &message.RawRequest{Path: req.Method[:dot], Method: req.Method[dot+1:]}
+	switch params := bytes.TrimSpace(req.Params); {
+	case len(params) == 0 || bytes.Equal(params, jsonrpcNull):
+	case params[0] == '[':
+		if err := json.Unmarshal(params, &rawReq.Args); err != nil {
+			return newJSONRPCError(req.ID, jsonrpcInvalidParams, "invalid params: "+err.Error())
+		}
+	case params[0] == '{':
+		// named params are the single argument
+		rawReq.Args = []json.RawMessage{params}
+	default:
+		return newJSONRPCError(req.ID, jsonrpcInvalidRequest, "invalid request: params must be an array or an object")
+	}
+
+	resp := newResponse(s.handleRequest(ctx, rawReq))
+	if resp.Error != "" {
+		if resp.ErrCode != message.CodeApplication {
+			log.Print("ferry.ServeJSONRPC: handleRequest: ", resp.Error)
+		}
+		return newJSONRPCError(req.ID, jsonrpcCode(resp.ErrCode), resp.Error)
+	}
+
+	// the replys without the trailing error, a single one stands alone
+	var result interface{}
+	if n := len(resp.Result); n == 2 {
+		result = resp.Result[0]
+	} else if n > 2 {
+		result = resp.Result[:n-1]
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Print("ferry.ServeJSONRPC: Marshal: ", err.Error())
+		return newJSONRPCError(req.ID, jsonrpcInternalError, "ferry.ServeJSONRPC: Marshal: "+err.Error())
+	}
+	return &jsonrpcResponse{Version: "2.0", Result: data, ID: req.ID}
+}
+
+// validJSONRPCID reports whether id is absent, a string, a number or null
+func validJSONRPCID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	var v interface{}
+	json.Unmarshal(id, &v)
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+// jsonrpcCode returns the JSON-RPC error code of a ferry error code
+func jsonrpcCode(code uint) int {
+	switch code {
+	case message.CodeInvalidRequest:
+		return jsonrpcInvalidParams
+	case message.CodeServiceUnavailable, message.CodeMethodNotFound:
+		return jsonrpcMethodNotFound
+	case message.CodeApplication:
+		return jsonrpcServerError
+	}
+	return jsonrpcInternalError
+}
+
+// encodeJSONRPC encodes a response or a batch of responses
+func encodeJSONRPC(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print("ferry.ServeJSONRPC: Marshal: ", err.Error())
+		data, _ = json.Marshal(newJSONRPCError(nil, jsonrpcInternalError, "ferry.ServeJSONRPC: Marshal: "+err.Error()))
+	}
+	return data
+}
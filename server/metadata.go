@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"net/textproto"
+)
+
+// Metadata holds the headers of a request, such as the HTTP headers passed
+// by HTTPHandler. Keys are in canonical form, as in net/http.
+type Metadata map[string][]string
+
+// Get returns the first value of key, or ""
+func (md Metadata) Get(key string) string {
+	values := md[textproto.CanonicalMIMEHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// metadataKey is the context key of the request metadata
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying md
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the metadata of the request handled with ctx,
+// methods taking a context.Context read it there
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	return md, ok
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"github.com/sunlidea/ferry/schema"
+	"sort"
+)
+
+// Services returns the sorted names of the registered services,
+// without the reflection service
+func (s *Server) Services() []string {
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+	names := make([]string, 0, len(s.serviceMap))
+	for _, svc := range s.serviceMap {
+		if svc.name != schema.ReflectionService {
+			names = append(names, svc.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe returns the schema of the named services, or of every service
+// but the reflection service if names is empty
+func (s *Server) Describe(names ...string) (*schema.Schema, error) {
+	if len(names) == 0 {
+		names = s.Services()
+	}
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+	sc := schema.New()
+	for _, name := range names {
+		svc, ok := s.serviceMap[canonicalName(name)]
+		if !ok {
+			return nil, errors.New("rpc.Describe: can't find service " + name)
+		}
+		for mname, m := range svc.method {
+			sc.AddMethod(name, mname, m.ArgTypes, m.ReplyTypes)
+		}
+	}
+	return sc, nil
+}
+
+// RegisterReflection publishes the reflection service, through which
+// clients list the services and fetch their schema (see schema.ReflectionProxy)
+func (s *Server) RegisterReflection() error {
+	list := func() ([]string, error) {
+		return s.Services(), nil
+	}
+	if err := s.RegisterFunc(schema.ReflectionService, "List", list); err != nil {
+		return err
+	}
+	describe := func(names []string) (*schema.Schema, error) {
+		return s.Describe(names...)
+	}
+	return s.RegisterFunc(schema.ReflectionService, "Describe", describe)
+}
@@ -2,14 +2,17 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/transport"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode"
@@ -35,6 +38,9 @@ type service struct {
 type methodType struct {
 	sync.Mutex // protects counters
 	method     reflect.Method
+	fn         reflect.Value // function registered by RegisterFunc, called without receiver
+	handler    handlerFunc   // typed handler registered by Handle, called without reflection
+	context    bool          // the method takes the request context as first argument
 	ArgTypes   []reflect.Type
 	ReplyTypes []reflect.Type
 	numCalls   uint
@@ -43,13 +49,15 @@ type methodType struct {
 // Server is a RPC server to serve RPC requests
 type Server struct {
 	serviceMapMu sync.RWMutex
-	serviceMap   map[string]*service // map[string]*service
+	serviceMap   map[string]*service // by canonical name, see canonicalName
+	versions     map[string][]string // canonical names of the versions of an unversioned name
 }
 
 // NewServer creates the RPC server instance
 func NewServer() *Server {
 	return &Server{
 		serviceMap: make(map[string]*service),
+		versions:   make(map[string][]string),
 	}
 }
 
@@ -58,12 +66,185 @@ func (s *Server) Register(rcvr interface{}) error {
 	return s.register(rcvr, "", false)
 }
 
+// RegisterName is like Register but uses the provided name for the service
+// instead of the receiver's concrete type. The name may be a hierarchical
+// path such as "billing/v2/Invoice" or "billing.v2.Invoice".
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	return s.register(rcvr, name, true)
+}
+
 // Register publishes in the server the set of methods of the
 // receiver value
 func (s *Server) register(rcvr interface{}, name string, useName bool) error {
+	service, err := s.newService(rcvr, name, useName)
+	if err != nil {
+		return err
+	}
+
+	s.serviceMapMu.Lock()
+	defer s.serviceMapMu.Unlock()
+
+	if _, dup := s.serviceMap[canonicalName(service.name)]; dup {
+		s := "rpc.Register: service already defined: " + service.name
+		log.Print(s)
+		return errors.New(s)
+	}
+	s.addService(service)
+	return nil
+}
+
+// addService adds or replaces svc, the caller holds serviceMapMu
+func (s *Server) addService(svc *service) {
+	key := canonicalName(svc.name)
+	if _, ok := s.serviceMap[key]; !ok {
+		base := unversioned(key)
+		s.versions[base] = append(s.versions[base], key)
+	}
+	s.serviceMap[key] = svc
+}
+
+// removeService removes the service of the canonical name key,
+// the caller holds serviceMapMu
+func (s *Server) removeService(key string) {
+	delete(s.serviceMap, key)
+	base := unversioned(key)
+	keys := s.versions[base]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(s.versions, base)
+	} else {
+		s.versions[base] = keys
+	}
+}
+
+// Unregister removes the named service from the server. Calls already
+// running finish normally, later calls fail with CodeServiceUnavailable.
+func (s *Server) Unregister(name string) error {
+	s.serviceMapMu.Lock()
+	defer s.serviceMapMu.Unlock()
+
+	key := canonicalName(name)
+	if _, ok := s.serviceMap[key]; !ok {
+		return errors.New("rpc.Unregister: service not defined: " + name)
+	}
+	s.removeService(key)
+	return nil
+}
+
+// Replace atomically swaps the receiver of the named service.
+// Calls already running finish on the old receiver,
+// new calls are served by rcvr.
+func (s *Server) Replace(name string, rcvr interface{}) error {
+	service, err := s.newService(rcvr, name, true)
+	if err != nil {
+		return err
+	}
+
+	s.serviceMapMu.Lock()
+	defer s.serviceMapMu.Unlock()
+
+	old, ok := s.serviceMap[canonicalName(name)]
+	if !ok {
+		return errors.New("rpc.Replace: service not defined: " + name)
+	}
+	// the service keeps the name it was registered with
+	service.name = old.name
+	// functions registered by RegisterFunc and Handle stay in place
+	for mname, m := range old.method {
+		if _, dup := service.method[mname]; !dup && (m.fn.IsValid() || m.handler != nil) {
+			service.method[mname] = m
+		}
+	}
+	s.addService(service)
+	return nil
+}
+
+// RegisterFunc publishes fn as a method of the named service. fn may be
+// any function or closure whose last return value is an error, its
+// arguments are decoded the same way as for methods of a receiver.
+// The service is created if it doesn't exist yet.
+func (s *Server) RegisterFunc(serviceName, methodName string, fn interface{}) error {
+	if err := checkNames(serviceName, methodName); err != nil {
+		return err
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		str := "rpc.RegisterFunc: " + serviceName + "." + methodName + " is not a function"
+		log.Print(str)
+		return errors.New(str)
+	}
+	ftype := fv.Type()
+	if reason := checkMethod(ftype, 0); reason != "" {
+		err := &RegisterError{Type: ftype.String(), Methods: []MethodError{{Method: methodName, Reason: reason}}}
+		log.Print(err.Error())
+		return err
+	}
+
+	m := &methodType{
+		method:  reflect.Method{Name: methodName, Type: ftype, Func: fv},
+		fn:      fv,
+		context: hasContext(ftype, 0),
+	}
+	first := 0
+	if m.context {
+		first = 1
+	}
+	for i := first; i < ftype.NumIn(); i++ {
+		m.ArgTypes = append(m.ArgTypes, ftype.In(i))
+	}
+	for i := 0; i < ftype.NumOut(); i++ {
+		m.ReplyTypes = append(m.ReplyTypes, ftype.Out(i))
+	}
+
+	return s.addMethod(serviceName, methodName, m)
+}
+
+// checkNames validates the names used by RegisterFunc and Handle
+func checkNames(serviceName, methodName string) error {
+	if !isValidPath(serviceName) {
+		str := "rpc.Register: invalid service name " + strconv.Quote(serviceName)
+		log.Print(str)
+		return errors.New(str)
+	}
+	if !isExported(methodName) || strings.ContainsAny(methodName, "./") {
+		str := "rpc.Register: method " + strconv.Quote(methodName) + " is not exported"
+		log.Print(str)
+		return errors.New(str)
+	}
+	return nil
+}
+
+// addMethod adds m to the named service, creating the service if needed
+func (s *Server) addMethod(serviceName, methodName string, m *methodType) error {
 	s.serviceMapMu.Lock()
 	defer s.serviceMapMu.Unlock()
 
+	// copy the service, calls in flight keep reading the old method set
+	svc := &service{name: serviceName, method: make(map[string]*methodType)}
+	if old, ok := s.serviceMap[canonicalName(serviceName)]; ok {
+		if _, dup := old.method[methodName]; dup {
+			str := "rpc.Register: method already defined: " + serviceName + "." + methodName
+			log.Print(str)
+			return errors.New(str)
+		}
+		*svc = service{name: old.name, rcvr: old.rcvr, typ: old.typ, method: svc.method}
+		for name, om := range old.method {
+			svc.method[name] = om
+		}
+	}
+	svc.method[methodName] = m
+	s.addService(svc)
+	return nil
+}
+
+// newService builds the service for the receiver value
+// and checks the set of its methods
+func (s *Server) newService(rcvr interface{}, name string, useName bool) (*service, error) {
 	service := new(service)
 	service.typ = reflect.TypeOf(rcvr)
 	service.rcvr = reflect.ValueOf(rcvr)
@@ -76,38 +257,57 @@ func (s *Server) register(rcvr interface{}, name string, useName bool) error {
 	if sname == "" {
 		s := "rpc.Register: no service name for type " + service.typ.String()
 		log.Print(s)
-		return errors.New(s)
+		return nil, errors.New(s)
 	}
 	if !isExported(sname) && !useName {
 		s := "rpc.Register: type " + sname + " is not exported"
 		log.Print(s)
-		return errors.New(s)
+		return nil, errors.New(s)
+	}
+	if useName && !isValidPath(sname) {
+		s := "rpc.Register: invalid service name " + strconv.Quote(sname)
+		log.Print(s)
+		return nil, errors.New(s)
 	}
 	service.name = sname
 
 	// install the methods
-	service.method = s.suitableMethods(service.typ)
+	methods, err := s.suitableMethods(service.typ)
+	if err != nil {
+		log.Print(err.Error())
+		return nil, err
+	}
+	service.method = methods
 
 	if len(service.method) == 0 {
 		str := ""
 		// To help the user, see if a pointer receiver would work.
-		method := s.suitableMethods(reflect.PtrTo(service.typ))
+		method, err := s.suitableMethods(reflect.PtrTo(service.typ))
+		if regErr, ok := err.(*RegisterError); ok {
+			// the pointer has methods, some of them unsuitable
+			regErr.Hint = "pass a pointer to value of that type"
+			log.Print(regErr.Error())
+			return nil, regErr
+		}
 		if len(method) != 0 {
 			str = "rpc.Register: type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)"
 		} else {
 			str = "rpc.Register: type " + sname + " has no exported methods of suitable type"
 		}
 		log.Print(str)
-		return errors.New(str)
+		return nil, errors.New(str)
 	}
 
-	s.serviceMap[service.name] = service
-	return nil
+	return service, nil
 }
 
-// suitableMethods returns suitable Rpc methods of typ
-func (s *Server) suitableMethods(typ reflect.Type) map[string]*methodType {
+// suitableMethods returns suitable Rpc methods of typ.
+// Every exported method must have error as its last return value and
+// arguments and replys the codec is able to carry, otherwise
+// a *RegisterError listing the rejected methods is returned.
+func (s *Server) suitableMethods(typ reflect.Type) (map[string]*methodType, error) {
 	methods := make(map[string]*methodType)
+	var rejected []MethodError
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
 		if method.PkgPath != "" {
@@ -116,20 +316,19 @@ func (s *Server) suitableMethods(typ reflect.Type) map[string]*methodType {
 		}
 		mtype := method.Type
 
-		if !mtype.Out(mtype.NumOut() - 1).Implements(typeOfError) {
-			// last return type must be error
-			log.Printf("rpc.Register: last return type of method %q is %q, must be error\n",
-				method.Name, mtype.Out(m))
+		if reason := checkMethod(mtype, 1); reason != "" {
+			rejected = append(rejected, MethodError{Method: method.Name, Reason: reason})
 			continue
 		}
 
-		//TODO
-		//need check Argtypes and ReplyTypes
-
 		// input arguments of the method
 		argTypes := make([]reflect.Type, 0, mtype.NumIn())
-		// first param is method receiver
-		for i := 1; i < mtype.NumIn(); i++ {
+		// first param is method receiver, it may be followed by a context
+		first := 1
+		if hasContext(mtype, 1) {
+			first = 2
+		}
+		for i := first; i < mtype.NumIn(); i++ {
 			argTypes = append(argTypes, mtype.In(i))
 		}
 
@@ -144,9 +343,13 @@ func (s *Server) suitableMethods(typ reflect.Type) map[string]*methodType {
 			method:     method,
 			ArgTypes:   argTypes,
 			ReplyTypes: replyTypes,
+			context:    first == 2,
 		}
 	}
-	return methods
+	if len(rejected) > 0 {
+		return nil, &RegisterError{Type: typ.String(), Methods: rejected}
+	}
+	return methods, nil
 }
 
 func isExported(name string) bool {
@@ -154,24 +357,124 @@ func isExported(name string) bool {
 	return unicode.IsUpper(r)
 }
 
+// isValidPath reports whether name is a service path made of
+// non-empty segments separated by '/' or '.'
+func isValidPath(name string) bool {
+	segs := strings.Split(strings.Replace(name, ".", "/", -1), "/")
+	for _, seg := range segs {
+		if seg == "" {
+			return false
+		}
+		for _, r := range seg {
+			if r != '_' && r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// canonicalName returns the key of a service path, with '/' as separator:
+// "billing.v2.Invoice" and "billing/v2/Invoice" are the same service
+func canonicalName(name string) string {
+	return strings.Join(splitPath(name), "/")
+}
+
+// splitPath splits a service path into its segments
+func splitPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '.'
+	})
+}
+
+// isVersion reports whether a path segment is a version such as "v2"
+func isVersion(seg string) bool {
+	if len(seg) < 2 || seg[0] != 'v' {
+		return false
+	}
+	for _, r := range seg[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// unversioned returns the path with its version segments removed,
+// "billing/v2/Invoice" and "billing/Invoice/v2" both become "billing/Invoice"
+func unversioned(name string) string {
+	segs := splitPath(name)
+	kept := segs[:0]
+	for _, seg := range segs {
+		if !isVersion(seg) {
+			kept = append(kept, seg)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// lookupService finds the service registered for path, treating '/' and '.'
+// as the same separator. When there's no match and the path carries no
+// version, the only registered version of the service is used.
+func (s *Server) lookupService(path string) *service {
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+
+	key := canonicalName(path)
+	if service := s.serviceMap[key]; service != nil {
+		return service
+	}
+	// only look for other versions if the caller didn't ask for one
+	if key == "" || unversioned(key) != key {
+		return nil
+	}
+	keys := s.versions[key]
+	if len(keys) != 1 {
+		// missing or ambiguous, several versions registered
+		return nil
+	}
+	return s.serviceMap[keys[0]]
+}
+
 // Serve accepts connections on the listener and serves requests
-// for each incoming connection.
-func (s *Server) Serve(lis net.Listener) {
+// for each incoming connection. It returns the error ending Accept.
+func (s *Server) Serve(lis net.Listener) error {
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
 			log.Print("ferry.Serve: accpet:", err.Error())
-			return
+			return err
 		}
 		go s.ServeConn(conn)
 	}
 }
 
+// ListenAndServe listens on address, such as localhost:1234,
+// unix:///run/ferry.sock or inproc://arith (see package transport),
+// and serves the connections until Accept fails
+func (s *Server) ListenAndServe(address string) error {
+	lis, err := transport.Listen(address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// runningRequest is a request being handled by ServeConn
+type runningRequest struct {
+	cancel context.CancelFunc
+}
+
 // ServeConn reads message from conn then handle the message.
 func (s *Server) ServeConn(conn net.Conn) {
 
 	r := bufio.NewReaderSize(conn, ReadSize)
 
+	connCtx, connCancel := context.WithCancel(context.Background())
+	defer connCancel()
+	var inflightMu sync.Mutex
+	inflight := make(map[uint64]*runningRequest)
+
 	for {
 
 		// read the message
@@ -186,33 +489,72 @@ func (s *Server) ServeConn(conn net.Conn) {
 				return
 			}
 		}
-		if msg.MessageType != message.MsgTypeRequest {
+		switch msg.MessageType {
+		case message.MsgTypeRequest, message.MsgTypeOneway:
+		case message.MsgTypeCancel:
+			// the client gave up on the request
+			inflightMu.Lock()
+			if running := inflight[msg.SeqID]; running != nil {
+				running.cancel()
+			}
+			inflightMu.Unlock()
+			continue
+		default:
 			// not request message
-			log.Print("ferry.ServeConn: Invalid Message: ", err.Error())
+			log.Print("ferry.ServeConn: Invalid Message Type: ", msg.MessageType)
 			return
 		}
 
-		// get request body
-		req, err := msg.DecodeRequest()
-		if err != nil {
-			log.Print("ferry.ServeConn: DecodeRequest: ", err.Error())
-			return
+		// each request runs with a context canceled by a cancel message
+		// or when the connection is closed
+		reqCtx, reqCancel := context.WithCancel(connCtx)
+		running := &runningRequest{cancel: reqCancel}
+		inflightMu.Lock()
+		_, dup := inflight[msg.SeqID]
+		if !dup {
+			inflight[msg.SeqID] = running
+		}
+		inflightMu.Unlock()
+		if dup {
+			// its response would complete the running request
+			log.Print("ferry.ServeConn: request already running: ", msg.SeqID)
+			reqCancel()
+			continue
 		}
 
 		// handle the request
 		go func() {
-			replys, err := s.handleRequest(req)
+			defer func() {
+				inflightMu.Lock()
+				if inflight[msg.SeqID] == running {
+					delete(inflight, msg.SeqID)
+				}
+				inflightMu.Unlock()
+				reqCancel()
+			}()
+
+			var resp message.Response
+			// get request body
+			req, err := msg.DecodeRequest()
 			if err != nil {
-				log.Print("ferry.ServeConn: handleRequest: ", err.Error())
-				return
+				resp = newResponse(nil, message.Errorf(message.CodeInvalidRequest,
+					"ferry.ServeConn: DecodeRequest: %v", err))
+			} else {
+				resp = newResponse(s.handleRequest(reqCtx, req))
 			}
-			resp := message.Response{
-				Result: replys,
+			if resp.Error != "" && resp.ErrCode != message.CodeApplication {
+				log.Print("ferry.ServeConn: handleRequest: ", resp.Error)
 			}
+			if msg.MessageType == message.MsgTypeOneway {
+				// the client doesn't wait for a response
+				return
+			}
+
 			respData, err := json.Marshal(resp)
 			if err != nil {
 				log.Print("ferry.ServeConn: Marshal: ", err.Error())
-				return
+				respData, _ = json.Marshal(newResponse(nil, message.Errorf(message.CodeInternal,
+					"ferry.ServeConn: Marshal: %v", err)))
 			}
 
 			// wrap the response message
@@ -222,9 +564,14 @@ func (s *Server) ServeConn(conn net.Conn) {
 					MessageType:  message.MsgTypeResponse,
 					CompressType: msg.CompressType,
 					SeqID:        msg.SeqID,
-					BodyLength:   uint32(len(respData)),
+					Extension:    message.ExtCancel,
 				},
-				Data: respData,
+			}
+			if err = respMsg.SetBody(respData); err != nil {
+				// answer uncompressed
+				log.Print("ferry.ServeConn: SetBody: ", err.Error())
+				respMsg.CompressType = message.NoneCompress
+				respMsg.SetBody(respData)
 			}
 			// send the message to client
 			_, err = conn.Write(respMsg.Encode())
@@ -236,41 +583,77 @@ func (s *Server) ServeConn(conn net.Conn) {
 	}
 }
 
+// newResponse wraps the result of handleRequest in a response.
+// An error returned by the method itself is moved out of the results
+// and reported with CodeApplication.
+func newResponse(replys []interface{}, err error) message.Response {
+	if err != nil {
+		e, ok := err.(*message.Error)
+		if !ok {
+			e = &message.Error{Code: message.CodeInternal, Message: err.Error()}
+		}
+		return message.Response{ErrCode: e.Code, Error: e.Message}
+	}
+
+	resp := message.Response{Result: replys}
+	if n := len(replys); n > 0 {
+		if appErr, ok := replys[n-1].(error); ok && appErr != nil {
+			resp.ErrCode = message.CodeApplication
+			resp.Error = appErr.Error()
+			replys[n-1] = nil
+		}
+	}
+	return resp
+}
+
 // handleRequest finds the corresponding method,
 // then executes the method with arguments in the message.
-func (s *Server) handleRequest(req *message.RawRequest) ([]interface{}, error) {
+func (s *Server) handleRequest(ctx context.Context, req *message.RawRequest) ([]interface{}, error) {
 	serviceName := req.Path
 	serviceMethod := req.Method
 
 	// find the service
-	s.serviceMapMu.RLock()
-	service := s.serviceMap[serviceName]
-	s.serviceMapMu.RUnlock()
+	service := s.lookupService(serviceName)
 	if service == nil {
-		return nil, fmt.Errorf("ferry.handleRequest can't find service: %s", serviceName)
+		return nil, message.Errorf(message.CodeServiceUnavailable,
+			"ferry.handleRequest service unavailable: %s", serviceName)
 	}
 
 	// find the method
 	m := service.method[serviceMethod]
 	if m == nil {
-		return nil, fmt.Errorf("ferry.handleRequest can't find method: %s", serviceMethod)
+		return nil, message.Errorf(message.CodeMethodNotFound,
+			"ferry.handleRequest can't find method: %s", serviceMethod)
 	}
 
 	//args count must equal
 	if len(req.Args) != len(m.ArgTypes) {
-		return nil, fmt.Errorf("ferry.handleRequest method args count unequal, demand %d have %d",
+		return nil, message.Errorf(message.CodeInvalidRequest,
+			"ferry.handleRequest method args count unequal, demand %d have %d",
 			len(m.ArgTypes), len(req.Args))
 	}
 
+	if m.handler != nil {
+		return m.handler(ctx, req.Args)
+	}
+
 	function := m.method.Func
 	// wrap the input arguments
-	in := make([]reflect.Value, 0, len(req.Args)+1)
-	in = append(in, service.rcvr)
+	in := make([]reflect.Value, 0, len(req.Args)+2)
+	if m.fn.IsValid() {
+		function = m.fn
+	} else {
+		in = append(in, service.rcvr)
+	}
+	if m.context {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
 	for i, arg := range req.Args {
 		inst := reflect.New(m.ArgTypes[i])
 		err := json.Unmarshal(arg, inst.Interface())
 		if err != nil {
-			return nil, fmt.Errorf("ferry.handleRequest args %d Unmarshal Fail:%v", i, err)
+			return nil, message.Errorf(message.CodeInvalidRequest,
+				"ferry.handleRequest args %d Unmarshal Fail:%v", i, err)
 		}
 		in = append(in, inst.Elem())
 	}
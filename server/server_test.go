@@ -1,9 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/sunlidea/ferry/message"
+	"github.com/sunlidea/ferry/schema"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Arith int
@@ -45,7 +58,7 @@ func TestServer_handleRequest(t *testing.T) {
 		Args:   []json.RawMessage{argA, argB},
 	}
 
-	replys, err := s.handleRequest(rawReq)
+	replys, err := s.handleRequest(context.Background(), rawReq)
 	if err != nil || len(replys) != 2 {
 		t.Fatalf("TestServer_handleRequest|handleRequest|Fail|%v|%+v",
 			err.Error(), replys)
@@ -67,3 +80,780 @@ func TestServer_handleRequest(t *testing.T) {
 		return
 	}
 }
+
+type Invalid int
+
+func (t *Invalid) Add(A, B int) (int, error) {
+	return A + B, nil
+}
+
+func (t *Invalid) Watch(ch chan int) error {
+	return nil
+}
+
+func (t *Invalid) NoError(A int) int {
+	return A
+}
+
+func (t *Invalid) Nothing() {
+}
+
+// Test register rejects methods the codec can't carry
+func TestServer_RegisterInvalid(t *testing.T) {
+	s := NewServer()
+	err := s.Register(new(Invalid))
+	regErr, ok := err.(*RegisterError)
+	if !ok {
+		t.Fatalf("TestServer_RegisterInvalid|Register|Fail|%v", err)
+		return
+	}
+
+	rejected := make([]string, 0, len(regErr.Methods))
+	for _, m := range regErr.Methods {
+		rejected = append(rejected, m.Method)
+	}
+	if diff := cmp.Diff([]string{"NoError", "Nothing", "Watch"}, rejected); diff != "" {
+		t.Fatalf("TestServer_RegisterInvalid|Methods|Fail|%s", diff)
+	}
+	if _, ok := s.serviceMap["Invalid"]; ok {
+		t.Fatalf("TestServer_RegisterInvalid|serviceMap|Fail|registered")
+	}
+
+	// the value has no methods, the hint survives the rejected ones
+	err = s.Register(Invalid(0))
+	if regErr, ok := err.(*RegisterError); !ok || regErr.Hint == "" || !strings.Contains(err.Error(), "hint: pass a pointer") {
+		t.Fatalf("TestServer_RegisterInvalid|value|Fail|%v", err)
+	}
+}
+
+// Test register with names and lookup of hierarchical paths
+func TestServer_RegisterName(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterName("billing/v2/Arith", new(Arith))
+	if err != nil {
+		t.Fatalf("TestServer_RegisterName|RegisterName|Fail|%v", err)
+		return
+	}
+	for _, name := range []string{"billing/v2/Arith", "billing.v2.Arith", "billing/v2.Arith"} {
+		if err := s.RegisterName(name, new(Arith)); err == nil {
+			t.Fatalf("TestServer_RegisterName|RegisterName|duplicate %q accepted", name)
+			return
+		}
+	}
+	for _, name := range []string{"", "billing//Arith", "billing/Ar ith", "/Arith"} {
+		if err := s.RegisterName(name, new(Arith)); err == nil {
+			t.Fatalf("TestServer_RegisterName|RegisterName|invalid name %q accepted", name)
+			return
+		}
+	}
+
+	for _, path := range []string{"billing/v2/Arith", "billing.v2.Arith", "billing/Arith"} {
+		if s.lookupService(path) == nil {
+			t.Fatalf("TestServer_RegisterName|lookupService|Fail|%s", path)
+			return
+		}
+	}
+	if s.lookupService("billing/v1/Arith") != nil {
+		t.Fatalf("TestServer_RegisterName|lookupService|wrong version resolved")
+		return
+	}
+
+	// with two versions the unversioned path is ambiguous
+	err = s.RegisterName("billing/v3/Arith", new(Arith))
+	if err != nil {
+		t.Fatalf("TestServer_RegisterName|RegisterName|Fail|%v", err)
+		return
+	}
+	if s.lookupService("billing/Arith") != nil {
+		t.Fatalf("TestServer_RegisterName|lookupService|ambiguous path resolved")
+		return
+	}
+	if s.lookupService("billing/v3/Arith") == nil {
+		t.Fatalf("TestServer_RegisterName|lookupService|Fail|billing/v3/Arith")
+		return
+	}
+
+	// removing a version under another spelling makes the path unambiguous again
+	if err := s.Unregister("billing.v3.Arith"); err != nil {
+		t.Fatalf("TestServer_RegisterName|Unregister|Fail|%v", err)
+		return
+	}
+	if s.lookupService("billing.Arith") == nil {
+		t.Fatalf("TestServer_RegisterName|lookupService|Fail|billing.Arith")
+	}
+}
+
+type Counter struct {
+	base    int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *Counter) Next(n int) (int, error) {
+	if c.release != nil {
+		c.started <- struct{}{}
+		<-c.release
+	}
+	return c.base + n, nil
+}
+
+// Test replacing and removing a service at runtime
+func TestServer_ReplaceAndUnregister(t *testing.T) {
+	s := NewServer()
+	old := &Counter{base: 100, started: make(chan struct{}), release: make(chan struct{})}
+	err := s.Register(old)
+	if err != nil {
+		t.Fatalf("TestServer_ReplaceAndUnregister|Register|Fail|%v", err)
+		return
+	}
+
+	arg, _ := json.Marshal(1)
+	rawReq := &message.RawRequest{
+		Path:   "Counter",
+		Method: "Next",
+		Args:   []json.RawMessage{arg},
+	}
+
+	// a call in flight on the old receiver
+	inflight := make(chan []interface{}, 1)
+	go func() {
+		replys, _ := s.handleRequest(context.Background(), rawReq)
+		inflight <- replys
+	}()
+	<-old.started
+
+	err = s.Replace("Counter", &Counter{base: 200})
+	if err != nil {
+		t.Fatalf("TestServer_ReplaceAndUnregister|Replace|Fail|%v", err)
+		return
+	}
+	replys, err := s.handleRequest(context.Background(), rawReq)
+	if err != nil || replys[0] != 201 {
+		t.Fatalf("TestServer_ReplaceAndUnregister|new receiver|Fail|%v|%+v", err, replys)
+		return
+	}
+
+	close(old.release)
+	if replys := <-inflight; replys[0] != 101 {
+		t.Fatalf("TestServer_ReplaceAndUnregister|old receiver|Fail|%+v", replys)
+		return
+	}
+
+	err = s.Unregister("Counter")
+	if err != nil {
+		t.Fatalf("TestServer_ReplaceAndUnregister|Unregister|Fail|%v", err)
+		return
+	}
+	_, err = s.handleRequest(context.Background(), rawReq)
+	if e, ok := err.(*message.Error); !ok || e.Code != message.CodeServiceUnavailable {
+		t.Fatalf("TestServer_ReplaceAndUnregister|removed service|Fail|%v", err)
+		return
+	}
+	if err := s.Replace("Counter", &Counter{}); err == nil {
+		t.Fatalf("TestServer_ReplaceAndUnregister|Replace|removed service replaced")
+	}
+}
+
+// Test register plain functions and closures
+func TestServer_RegisterFunc(t *testing.T) {
+	s := NewServer()
+	offset := 10
+	err := s.RegisterFunc("Math", "AddOffset", func(a int) (int, error) {
+		return a + offset, nil
+	})
+	if err != nil {
+		t.Fatalf("TestServer_RegisterFunc|RegisterFunc|Fail|%v", err)
+		return
+	}
+
+	// functions can join a service registered with a receiver
+	err = s.Register(new(Arith))
+	if err != nil {
+		t.Fatalf("TestServer_RegisterFunc|Register|Fail|%v", err)
+		return
+	}
+	err = s.RegisterFunc("Arith", "Sub", func(a, b int) (int, error) {
+		return a - b, nil
+	})
+	if err != nil {
+		t.Fatalf("TestServer_RegisterFunc|RegisterFunc|Fail|%v", err)
+		return
+	}
+
+	for _, bad := range []interface{}{nil, 1, func(a int) int { return a }, func(ch chan int) error { return nil }} {
+		if err := s.RegisterFunc("Math", "Bad", bad); err == nil {
+			t.Fatalf("TestServer_RegisterFunc|RegisterFunc|accepted %T", bad)
+			return
+		}
+	}
+	if err := s.RegisterFunc("Arith", "Add", func() error { return nil }); err == nil {
+		t.Fatalf("TestServer_RegisterFunc|RegisterFunc|duplicate accepted")
+		return
+	}
+
+	for _, c := range []struct {
+		path, method string
+		args         []int
+		want         int
+	}{
+		{"Math", "AddOffset", []int{1}, 11},
+		{"Arith", "Sub", []int{5, 3}, 2},
+		{"Arith", "Add", []int{5, 3}, 8},
+	} {
+		rawReq := &message.RawRequest{Path: c.path, Method: c.method}
+		for _, a := range c.args {
+			arg, _ := json.Marshal(a)
+			rawReq.Args = append(rawReq.Args, arg)
+		}
+		replys, err := s.handleRequest(context.Background(), rawReq)
+		if err != nil || replys[0] != c.want {
+			t.Fatalf("TestServer_RegisterFunc|%s.%s|Fail|%v|%+v", c.path, c.method, err, replys)
+			return
+		}
+	}
+}
+
+// Test a cancel message cancels the context of the request
+func TestServer_Cancel(t *testing.T) {
+	s := NewServer()
+	started := make(chan struct{}, 2)
+	canceled := make(chan struct{})
+	err := s.RegisterFunc("Sleep", "Wait", func(ctx context.Context, d int) (int, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return 0, ctx.Err()
+		case <-time.After(time.Duration(d) * time.Millisecond):
+			return d, nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("TestServer_Cancel|RegisterFunc|Fail|%v", err)
+		return
+	}
+
+	conn, srv := net.Pipe()
+	defer conn.Close()
+	go s.ServeConn(srv)
+
+	body, _ := json.Marshal(&message.Request{Path: "Sleep", Method: "Wait", Args: []interface{}{5000}})
+	req := message.Message{
+		Header: &message.Header{MessageType: message.MsgTypeRequest, SeqID: 7, BodyLength: uint32(len(body))},
+		Data:   body,
+	}
+	if _, err := conn.Write(req.Encode()); err != nil {
+		t.Fatalf("TestServer_Cancel|Write|Fail|%v", err)
+		return
+	}
+	<-started
+
+	// a request reusing a running SeqID is refused
+	if _, err := conn.Write(req.Encode()); err != nil {
+		t.Fatalf("TestServer_Cancel|Write|Fail|%v", err)
+		return
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(started) != 0 {
+		t.Fatalf("TestServer_Cancel|duplicate SeqID|Fail|started")
+		return
+	}
+
+	cancel := message.Message{Header: &message.Header{MessageType: message.MsgTypeCancel, SeqID: 7}}
+	if _, err := conn.Write(cancel.Encode()); err != nil {
+		t.Fatalf("TestServer_Cancel|Cancel|Fail|%v", err)
+		return
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("TestServer_Cancel|context not canceled")
+		return
+	}
+
+	msg, err := message.RecvMessage(conn)
+	if err != nil || msg.SeqID != 7 || msg.Extension&message.ExtCancel == 0 {
+		t.Fatalf("TestServer_Cancel|RecvMessage|Fail|%v", err)
+		return
+	}
+	resp, err := msg.DecodeResponse()
+	if err != nil || resp.ErrCode != message.CodeApplication {
+		t.Fatalf("TestServer_Cancel|DecodeResponse|Fail|%v|%+v", err, resp)
+	}
+}
+
+type Pair struct {
+	A, B int
+}
+
+type Sum struct {
+	N int
+}
+
+func (t *Arith) AddPair(p *Pair) (*Sum, error) {
+	return &Sum{N: p.A + p.B}, nil
+}
+
+// Test typed handlers published by Handle
+func TestHandle(t *testing.T) {
+	s := NewServer()
+	err := Handle(s, "Typed", "AddPair", func(ctx context.Context, p *Pair) (*Sum, error) {
+		if p.A < 0 {
+			return nil, errors.New("negative")
+		}
+		return &Sum{N: p.A + p.B}, nil
+	})
+	if err != nil {
+		t.Fatalf("TestHandle|Handle|Fail|%v", err)
+		return
+	}
+
+	arg, _ := json.Marshal(&Pair{A: 3, B: 4})
+	rawReq := &message.RawRequest{Path: "Typed", Method: "AddPair", Args: []json.RawMessage{arg}}
+	replys, err := s.handleRequest(context.Background(), rawReq)
+	if err != nil || replys[0].(*Sum).N != 7 {
+		t.Fatalf("TestHandle|handleRequest|Fail|%v|%+v", err, replys)
+		return
+	}
+
+	arg, _ = json.Marshal(&Pair{A: -1})
+	rawReq.Args = []json.RawMessage{arg}
+	resp := newResponse(s.handleRequest(context.Background(), rawReq))
+	if resp.ErrCode != message.CodeApplication || resp.Error != "negative" {
+		t.Fatalf("TestHandle|error|Fail|%+v", resp)
+		return
+	}
+
+	// typed handlers survive the replacement of the receiver
+	if err := s.Register(&Counter{base: 1}); err != nil {
+		t.Fatalf("TestHandle|Register|Fail|%v", err)
+		return
+	}
+	err = Handle(s, "Counter", "AddPair", func(ctx context.Context, p *Pair) (*Sum, error) {
+		return &Sum{N: p.A + p.B}, nil
+	})
+	if err != nil {
+		t.Fatalf("TestHandle|Handle Counter|Fail|%v", err)
+		return
+	}
+	if err := s.Replace("Counter", &Counter{base: 2}); err != nil {
+		t.Fatalf("TestHandle|Replace|Fail|%v", err)
+		return
+	}
+	arg, _ = json.Marshal(&Pair{A: 1, B: 2})
+	rawReq = &message.RawRequest{Path: "Counter", Method: "AddPair", Args: []json.RawMessage{arg}}
+	replys, err = s.handleRequest(context.Background(), rawReq)
+	if err != nil || replys[0].(*Sum).N != 3 {
+		t.Fatalf("TestHandle|replaced|Fail|%v|%+v", err, replys)
+	}
+}
+
+func benchmarkHandleRequest(b *testing.B, s *Server, path string) {
+	arg, _ := json.Marshal(&Pair{A: 3, B: 4})
+	rawReq := &message.RawRequest{Path: path, Method: "AddPair", Args: []json.RawMessage{arg}}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.handleRequest(ctx, rawReq); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark the reflective dispatch of a registered receiver
+func BenchmarkServer_handleRequest(b *testing.B) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkHandleRequest(b, s, "Arith")
+}
+
+// Benchmark the dispatch of a typed handler
+func BenchmarkServer_handleRequestTyped(b *testing.B) {
+	s := NewServer()
+	arith := new(Arith)
+	err := Handle(s, "Arith", "AddPair", func(ctx context.Context, p *Pair) (*Sum, error) {
+		return arith.AddPair(p)
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkHandleRequest(b, s, "Arith")
+}
+
+// Test the schema of the services published by the reflection service
+func TestServer_Describe(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestServer_Describe|Register|Fail|%v", err)
+		return
+	}
+	if err := s.RegisterReflection(); err != nil {
+		t.Fatalf("TestServer_Describe|RegisterReflection|Fail|%v", err)
+		return
+	}
+
+	replys, err := s.handleRequest(context.Background(), &message.RawRequest{Path: schema.ReflectionService, Method: "List"})
+	if err != nil {
+		t.Fatalf("TestServer_Describe|List|Fail|%v", err)
+		return
+	}
+	if diff := cmp.Diff([]string{"Arith"}, replys[0]); diff != "" {
+		t.Fatalf("TestServer_Describe|List|Fail|%s", diff)
+	}
+
+	arg, _ := json.Marshal([]string{"Arith"})
+	rawReq := &message.RawRequest{Path: schema.ReflectionService, Method: "Describe", Args: []json.RawMessage{arg}}
+	replys, err = s.handleRequest(context.Background(), rawReq)
+	if err != nil {
+		t.Fatalf("TestServer_Describe|Describe|Fail|%v", err)
+		return
+	}
+	sc := replys[0].(*schema.Schema)
+	m := sc.Service("Arith").Method("AddPair")
+	pair, sum := "github.com/sunlidea/ferry/server.Pair", "github.com/sunlidea/ferry/server.Sum"
+	if m == nil || !cmp.Equal(m.Args, []string{pair}) || !cmp.Equal(m.Replys, []string{sum}) {
+		t.Fatalf("TestServer_Describe|AddPair|Fail|%+v", m)
+	}
+	want := &schema.Type{Fields: []*schema.Field{{Name: "A", JSON: "A", Type: "int"}, {Name: "B", JSON: "B", Type: "int"}}}
+	if diff := cmp.Diff(want, sc.Types[pair]); diff != "" {
+		t.Fatalf("TestServer_Describe|Pair|Fail|%s", diff)
+	}
+
+	if _, err := s.Describe("Missing"); err == nil {
+		t.Fatalf("TestServer_Describe|Missing|Fail|no error")
+	}
+}
+
+// Test calls through the HTTP gateway
+func TestHTTPHandler(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestHTTPHandler|Register|Fail|%v", err)
+		return
+	}
+	err := s.RegisterFunc("Auth", "User", func(ctx context.Context) (string, error) {
+		md, ok := MetadataFromContext(ctx)
+		if !ok || md.Get("x-user") == "" {
+			return "", errors.New("anonymous")
+		}
+		return md.Get("x-user"), nil
+	})
+	if err != nil {
+		t.Fatalf("TestHTTPHandler|RegisterFunc|Fail|%v", err)
+		return
+	}
+	h := HTTPHandler(s)
+
+	tests := []struct {
+		method, path, body string
+		header             string
+		status             int
+		want               string
+	}{
+		{"POST", "/Arith/Add", "[3, 4]", "", http.StatusOK, `{"code":0,"error":"","result":[7,null]}`},
+		{"POST", "/Auth/User", "", "ann", http.StatusOK, `{"code":0,"error":"","result":["ann",null]}`},
+		{"POST", "/Auth/User", "[]", "", http.StatusInternalServerError, `{"code":1,"error":"anonymous","result":["",null]}`},
+		{"POST", "/Arith/Add", "{}", "", http.StatusBadRequest, ""},
+		{"POST", "/Arith/Add", "[1]", "", http.StatusBadRequest, ""},
+		{"POST", "/Arith/Sub", "[1, 2]", "", http.StatusNotFound, ""},
+		{"POST", "/Missing/Add", "[1, 2]", "", http.StatusNotFound, ""},
+		{"POST", "/Arith", "[1, 2]", "", http.StatusNotFound, ""},
+		{"GET", "/Arith/Add", "", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.header != "" {
+			r.Header.Set("X-User", test.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("TestHTTPHandler|%s %s|Fail|%d|%s", test.method, test.path, w.Code, w.Body.String())
+			return
+		}
+		if test.want != "" && w.Body.String() != test.want {
+			t.Fatalf("TestHTTPHandler|%s %s|Fail|%s", test.method, test.path, w.Body.String())
+			return
+		}
+	}
+}
+
+// Test JSON-RPC 2.0 requests, batches and notifications
+func TestServer_JSONRPC(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestServer_JSONRPC|Register|Fail|%v", err)
+		return
+	}
+	notified := make(chan int, 4)
+	s.RegisterFunc("Util", "Fail", func() error { return errors.New("boom") })
+	s.RegisterFunc("Util", "Notify", func(n int) error {
+		notified <- n
+		return nil
+	})
+
+	tests := []struct {
+		req, resp string
+	}{
+		{`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [1, 2], "id": 1}`,
+			`{"jsonrpc":"2.0","result":3,"id":1}`},
+		{`{"jsonrpc": "2.0", "method": "Arith.AddPair", "params": {"A": 1, "B": 2}, "id": "a"}`,
+			`{"jsonrpc":"2.0","result":{"N":3},"id":"a"}`},
+		{`{"jsonrpc": "2.0", "method": "Util.Notify", "params": [5]}`, ``},
+		{`{"jsonrpc": "2.0", "method": "Util.Fail", "id": 2}`,
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"boom"},"id":2}`},
+		{`{"jsonrpc": "2.0", "method": "Arith.Sub", "params": [1, 2], "id": 3}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"ferry.handleRequest can't find method: Sub"},"id":3}`},
+		{`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [1], "id": 4}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"ferry.handleRequest method args count unequal, demand 2 have 1"},"id":4}`},
+		{`{"jsonrpc": "1.0", "method": "Arith.Add", "id": 5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: jsonrpc must be \"2.0\" and method must be set"},"id":5}`},
+		{`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [1, 2], "id": {}}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: id must be a string, a number or null"},"id":null}`},
+		{`{"jsonrpc": "2.0", "method"`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`},
+		{`[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: empty batch"},"id":null}`},
+		{`[{"jsonrpc": "2.0", "method": "Arith.Mul", "params": [3, 4], "id": 1}, {"jsonrpc": "2.0", "method": "Util.Notify", "params": [6]}, 1]`,
+			`[{"jsonrpc":"2.0","result":12,"id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: json: cannot unmarshal number into Go value of type server.jsonrpcRequest"},"id":null}]`},
+		{`[{"jsonrpc": "2.0", "method": "Util.Notify", "params": [7]}]`, ``},
+	}
+	for _, test := range tests {
+		resp := s.handleJSONRPC(context.Background(), []byte(test.req), make(chan struct{}, MaxJSONRPCCalls))
+		if string(resp) != test.resp {
+			t.Fatalf("TestServer_JSONRPC|%s|Fail|%s", test.req, resp)
+			return
+		}
+	}
+	for _, want := range []int{5, 6, 7} {
+		if n := <-notified; n != want {
+			t.Fatalf("TestServer_JSONRPC|Notify|Fail|%d", n)
+			return
+		}
+	}
+
+	// newline delimited requests on a connection
+	conn, srv := net.Pipe()
+	go s.ServeJSONRPCConn(srv)
+	go conn.Write([]byte(`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [2, 3], "id": 1}` + "\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != `{"jsonrpc":"2.0","result":5,"id":1}`+"\n" {
+		t.Fatalf("TestServer_JSONRPC|ServeJSONRPCConn|Fail|%v|%q", err, line)
+		return
+	}
+	conn.Close()
+
+	// over HTTP
+	h := JSONRPCHandler(s)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [2, 3], "id": 1}`)))
+	if w.Code != http.StatusOK || w.Body.String() != `{"jsonrpc":"2.0","result":5,"id":1}` {
+		t.Fatalf("TestServer_JSONRPC|JSONRPCHandler|Fail|%d|%s", w.Code, w.Body.String())
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc": "2.0", "method": "Util.Notify", "params": [8]}`)))
+	if w.Code != http.StatusNoContent || <-notified != 8 {
+		t.Fatalf("TestServer_JSONRPC|notification|Fail|%d", w.Code)
+	}
+}
+
+// Test JSON-RPC connections bound the line length and the running calls
+func TestServer_JSONRPCLimits(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestServer_JSONRPCLimits|Register|Fail|%v", err)
+		return
+	}
+	var mu sync.Mutex
+	running, most := 0, 0
+	release := make(chan struct{})
+	s.RegisterFunc("Util", "Wait", func() error {
+		mu.Lock()
+		if running++; running > most {
+			most = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	conn, srv := net.Pipe()
+	defer conn.Close()
+	go s.ServeJSONRPCConn(srv)
+	r := bufio.NewReader(conn)
+
+	go func() {
+		conn.Write(append(bytes.Repeat([]byte("x"), MaxHTTPBodySize+1), '\n'))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "Arith.Add", "params": [2, 3], "id": 1}` + "\n"))
+	}()
+	for _, want := range []string{
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: line too long"},"id":null}`,
+		`{"jsonrpc":"2.0","result":5,"id":1}`,
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil || line != want+"\n" {
+			t.Fatalf("TestServer_JSONRPCLimits|long line|Fail|%v|%q", err, line)
+			return
+		}
+	}
+
+	calls := make([]string, 2*MaxJSONRPCCalls)
+	for i := range calls {
+		calls[i] = fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Util.Wait", "id": %d}`, i)
+	}
+	batch := "[" + strings.Join(calls, ",") + "]\n"
+	go func() {
+		conn.Write([]byte(batch))
+		conn.Write([]byte(batch))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	n := most
+	mu.Unlock()
+	if n != MaxJSONRPCCalls {
+		t.Fatalf("TestServer_JSONRPCLimits|running|Fail|%d", n)
+		return
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("TestServer_JSONRPCLimits|batch|Fail|%v", err)
+			return
+		}
+	}
+}
+
+// Test Serve returns the error ending Accept
+func TestServer_Serve(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServer_Serve|Listen|Fail|%v", err)
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- NewServer().Serve(lis) }()
+	lis.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("TestServer_Serve|Fail|%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestServer_Serve|timeout")
+	}
+}
+
+// Test ferry connections taken over from an HTTP server
+func TestServer_HandleHTTP(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestServer_HandleHTTP|Register|Fail|%v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ferry", ConnectHandler(s))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ferry")
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("TestServer_HandleHTTP|plain GET|Fail|%v|%v", err, resp)
+		return
+	}
+	resp.Body.Close()
+
+	for _, handshake := range []string{
+		"CONNECT /ferry HTTP/1.1\r\nHost: ferry\r\n\r\n",
+		"GET /ferry HTTP/1.1\r\nHost: ferry\r\nConnection: Upgrade\r\nUpgrade: ferry\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("TestServer_HandleHTTP|Dial|Fail|%v", err)
+			return
+		}
+		// the request follows the handshake without waiting for the answer
+		body, _ := json.Marshal(&message.Request{Path: "Arith", Method: "Add", Args: []interface{}{3, 4}})
+		req := message.Message{
+			Header: &message.Header{MessageType: message.MsgTypeRequest, SeqID: 1, BodyLength: uint32(len(body))},
+			Data:   body,
+		}
+		if _, err := conn.Write(append([]byte(handshake), req.Encode()...)); err != nil {
+			t.Fatalf("TestServer_HandleHTTP|Write|Fail|%v", err)
+			return
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode/100 > 2 {
+			t.Fatalf("TestServer_HandleHTTP|handshake|Fail|%v|%v", err, resp)
+			return
+		}
+		msg, err := message.RecvMessage(br)
+		if err != nil {
+			t.Fatalf("TestServer_HandleHTTP|RecvMessage|Fail|%v", err)
+			return
+		}
+		raw, err := msg.DecodeResponse()
+		if err != nil || len(raw.Result) == 0 || string(raw.Result[0]) != "7" {
+			t.Fatalf("TestServer_HandleHTTP|DecodeResponse|Fail|%v|%+v", err, raw)
+			return
+		}
+		conn.Close()
+	}
+}
+
+// Test connections outlive the timeouts of the HTTP server they came from
+func TestServer_HandleHTTPTimeout(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestServer_HandleHTTPTimeout|Register|Fail|%v", err)
+		return
+	}
+	ts := httptest.NewUnstartedServer(ConnectHandler(s))
+	ts.Config.ReadTimeout = 50 * time.Millisecond
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("TestServer_HandleHTTPTimeout|Dial|Fail|%v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT /ferry HTTP/1.1\r\nHost: ferry\r\n\r\n")); err != nil {
+		t.Fatalf("TestServer_HandleHTTPTimeout|Write|Fail|%v", err)
+		return
+	}
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("TestServer_HandleHTTPTimeout|handshake|Fail|%v|%v", err, resp)
+		return
+	}
+
+	// the first request comes after the HTTP timeouts
+	time.Sleep(150 * time.Millisecond)
+	body, _ := json.Marshal(&message.Request{Path: "Arith", Method: "Add", Args: []interface{}{3, 4}})
+	req := message.Message{
+		Header: &message.Header{MessageType: message.MsgTypeRequest, SeqID: 1, BodyLength: uint32(len(body))},
+		Data:   body,
+	}
+	if _, err := conn.Write(req.Encode()); err != nil {
+		t.Fatalf("TestServer_HandleHTTPTimeout|Write request|Fail|%v", err)
+		return
+	}
+	msg, err := message.RecvMessage(br)
+	if err != nil {
+		t.Fatalf("TestServer_HandleHTTPTimeout|RecvMessage|Fail|%v", err)
+		return
+	}
+	if raw, err := msg.DecodeResponse(); err != nil || len(raw.Result) == 0 || string(raw.Result[0]) != "7" {
+		t.Fatalf("TestServer_HandleHTTPTimeout|DecodeResponse|Fail|%v|%+v", err, raw)
+	}
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// inprocTransport connects clients and servers of the same process
+// through pipes, listeners are found by name
+type inprocTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*inprocListener
+}
+
+func (t *inprocTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	t.mu.Lock()
+	l := t.listeners[name]
+	t.mu.Unlock()
+	if l == nil {
+		return nil, errors.New("ferry.transport: no inproc listener named " + name)
+	}
+
+	conn, srv := net.Pipe()
+	var err error
+	select {
+	case l.conns <- srv:
+		return conn, nil
+	case <-l.done:
+		err = errors.New("ferry.transport: inproc listener " + name + " closed")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	conn.Close()
+	srv.Close()
+	return nil, err
+}
+
+func (t *inprocTransport) Listen(name string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listeners == nil {
+		t.listeners = make(map[string]*inprocListener)
+	}
+	if _, ok := t.listeners[name]; ok {
+		return nil, errors.New("ferry.transport: inproc address " + name + " already in use")
+	}
+	l := &inprocListener{
+		transport: t,
+		addr:      inprocAddr(name),
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	t.listeners[name] = l
+	return l, nil
+}
+
+// inprocListener hands the server ends of the pipes dialed to Accept
+type inprocListener struct {
+	transport *inprocTransport
+	addr      inprocAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *inprocListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and frees the name
+func (l *inprocListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *inprocListener) Addr() net.Addr {
+	return l.addr
+}
+
+// inprocAddr is the name of an inproc listener
+type inprocAddr string
+
+func (a inprocAddr) Network() string {
+	return "inproc"
+}
+
+func (a inprocAddr) String() string {
+	return string(a)
+}
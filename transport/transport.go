@@ -0,0 +1,116 @@
+// Package transport dials and listens on the addresses of ferry servers,
+// choosing the transport from the scheme of the address:
+//
+//	localhost:1234, tcp://localhost:1234   TCP
+//	unix:///run/ferry.sock                 Unix domain socket
+//	inproc://arith                         in-process pipe
+//	tls://example.com:1234                 TLS over TCP
+//
+// In-process pipes skip the network stack but not serialization: calls
+// are encoded and decoded by the JSON codec as on any connection, so the
+// caller and the handler never share memory. The JSON codec has no
+// zero-copy mode to skip it. The tls transport dials with the system roots, servers
+// register their own with Register("tls", TLS(config)).
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Transport connects clients and servers on the addresses of a scheme,
+// the address passed to it has no scheme
+type Transport interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"tcp":    netTransport("tcp"),
+		"unix":   netTransport("unix"),
+		"inproc": new(inprocTransport),
+		"tls":    TLS(nil),
+	}
+)
+
+// Register makes t the transport of the addresses with scheme,
+// replacing the one registered before
+func Register(scheme string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[scheme] = t
+}
+
+// lookup returns the transport of addr and the address without scheme
+func lookup(addr string) (Transport, string, error) {
+	scheme, address := "tcp", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, address = addr[:i], addr[i+3:]
+	}
+	transportsMu.RLock()
+	t, ok := transports[scheme]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, "", errors.New("ferry.transport: unknown scheme " + scheme + " in " + addr)
+	}
+	return t, address, nil
+}
+
+// Dial connects to the server at addr
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t, address, err := lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(ctx, address)
+}
+
+// Listen listens for connections on addr
+func Listen(addr string) (net.Listener, error) {
+	t, address, err := lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(address)
+}
+
+// netTransport is a network of package net, such as tcp or unix
+type netTransport string
+
+func (n netTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, string(n), address)
+}
+
+func (n netTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(string(n), address)
+}
+
+// tlsTransport is TLS over TCP
+type tlsTransport struct {
+	config *tls.Config
+}
+
+// TLS returns a transport of TLS connections over TCP configured by config,
+// servers need its certificates. A nil config dials with the defaults.
+func TLS(config *tls.Config) Transport {
+	return &tlsTransport{config: config}
+}
+
+func (t *tlsTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	d := tls.Dialer{Config: t.config}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+func (t *tlsTransport) Listen(address string) (net.Listener, error) {
+	if t.config == nil {
+		return nil, errors.New("ferry.transport: tls listeners need a configuration, see TLS")
+	}
+	return tls.Listen("tcp", address, t.config)
+}
@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echo serves connections of lis by writing back what they read
+func echo(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// roundTrip dials addr and checks the echo of a message
+func roundTrip(t *testing.T, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("roundTrip|%s|Dial|Fail|%v", addr, err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("ferry"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ferry" {
+		t.Fatalf("roundTrip|%s|Read|Fail|%v|%q", addr, err, buf)
+	}
+}
+
+// Test the transports selected by the scheme of the addresses
+func TestTransports(t *testing.T) {
+	lis, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestTransports|tcp|Fail|%v", err)
+		return
+	}
+	defer lis.Close()
+	go echo(lis)
+	roundTrip(t, lis.Addr().String())
+	roundTrip(t, "tcp://"+lis.Addr().String())
+
+	sock := "unix://" + filepath.Join(t.TempDir(), "ferry.sock")
+	lis, err = Listen(sock)
+	if err != nil {
+		t.Fatalf("TestTransports|unix|Fail|%v", err)
+		return
+	}
+	defer lis.Close()
+	go echo(lis)
+	roundTrip(t, sock)
+
+	if _, err := Dial(context.Background(), "quic://localhost:1234"); err == nil {
+		t.Fatalf("TestTransports|unknown scheme|Fail|no error")
+	}
+}
+
+// Test in-process pipes
+func TestInproc(t *testing.T) {
+	lis, err := Listen("inproc://echo")
+	if err != nil {
+		t.Fatalf("TestInproc|Listen|Fail|%v", err)
+		return
+	}
+	go echo(lis)
+	roundTrip(t, "inproc://echo")
+
+	if _, err := Listen("inproc://echo"); err == nil {
+		t.Fatalf("TestInproc|address in use|Fail|no error")
+		return
+	}
+	lis.Close()
+	if _, err := Dial(context.Background(), "inproc://echo"); err == nil {
+		t.Fatalf("TestInproc|closed|Fail|no error")
+		return
+	}
+	// the name is free again
+	lis, err = Listen("inproc://echo")
+	if err != nil {
+		t.Fatalf("TestInproc|Listen again|Fail|%v", err)
+		return
+	}
+	lis.Close()
+}
+
+// Test TLS with a self-signed certificate
+func TestTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("TestTLS|GenerateKey|Fail|%v", err)
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ferry"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("TestTLS|CreateCertificate|Fail|%v", err)
+		return
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	srv := TLS(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	lis, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestTLS|Listen|Fail|%v", err)
+		return
+	}
+	defer lis.Close()
+	go echo(lis)
+
+	Register("tls-test", TLS(&tls.Config{RootCAs: roots, ServerName: "localhost"}))
+	roundTrip(t, "tls-test://"+lis.Addr().String())
+
+	if _, err := Listen("tls://127.0.0.1:0"); err == nil {
+		t.Fatalf("TestTLS|Listen without config|Fail|no error")
+	}
+}
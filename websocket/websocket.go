@@ -0,0 +1,292 @@
+// Package websocket carries ferry connections over WebSocket (RFC 6455), to
+// reach services through infrastructure that only lets HTTP through.
+//
+// A Conn is a net.Conn whose writes are sent as binary messages and whose
+// reads return the payload of the messages received, so it works with
+// Server.ServeConn and client.NewClient unchanged:
+//
+//	http.Handle("/ferry", websocket.Handler(s.ServeConn))
+//
+//	conn, err := websocket.Dial("ws://localhost:8080/ferry", nil, nil)
+//	c := client.NewClient(conn, "Arith", new(api.ArithProxy))
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// opcodes of the frames
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// status codes of close frames
+const (
+	closeNormal      = 1000
+	closeProtocol    = 1002
+	closeUnsupported = 1003
+)
+
+// maxControlPayload is the largest payload of a control frame
+const maxControlPayload = 125
+
+// ErrClosed is returned by writes after the close handshake started
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is a WebSocket connection carrying a byte stream in binary messages
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // the frames written are masked, those read are not
+
+	writeMu   sync.Mutex // a frame is written at once
+	closeSent bool
+
+	// state of the reader
+	remaining int64   // unread payload of the current frame
+	mask      [4]byte // masking key of the current frame
+	masked    bool
+	maskPos   int
+	inMessage bool // a fragmented message waits for its continuation
+	readErr   error
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, br: br, client: client}
+}
+
+// Read reads the payload of the binary messages received, answering the
+// pings and the close frame on the way. It returns io.EOF once the peer
+// closed the connection.
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, and handles control frames
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return c.fail(closeProtocol, "reserved bits set")
+	}
+	masked := head[1]&0x80 != 0
+	if masked == c.client {
+		// clients mask their frames, servers don't
+		return c.fail(closeProtocol, "invalid masking")
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		if ext[0]&0x80 != 0 {
+			return c.fail(closeProtocol, "invalid payload length")
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		if (opcode == opContinuation) != c.inMessage {
+			return c.fail(closeProtocol, "unexpected continuation")
+		}
+		c.inMessage = !fin
+		c.remaining = length
+		return nil
+	case opText:
+		return c.fail(closeUnsupported, "text messages are not supported")
+	case opClose, opPing, opPong:
+	default:
+		return c.fail(closeProtocol, fmt.Sprintf("unknown opcode %d", opcode))
+	}
+
+	// control frames are small and never fragmented
+	if !fin || length > maxControlPayload {
+		return c.fail(closeProtocol, "invalid control frame")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+	}
+	switch opcode {
+	case opPing:
+		if err := c.writeFrame(true, opPong, payload); err != nil && err != ErrClosed {
+			return err
+		}
+	case opClose:
+		// echo the status code and stop reading
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		c.writeClose(payload)
+		return io.EOF
+	}
+	return nil
+}
+
+// fail starts the close handshake after an error of the peer
+func (c *Conn) fail(code uint16, msg string) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.writeClose(payload[:])
+	return errors.New("websocket: " + msg)
+}
+
+// Write sends p as a binary message
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(true, opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a frame, masked if c is a client
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i&3])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// writeClose sends a close frame, unless one was sent already
+func (c *Conn) writeClose(payload []byte) {
+	c.writeFrame(true, opClose, payload)
+}
+
+// Close sends a close frame and closes the underlying connection
+func (c *Conn) Close() error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], closeNormal)
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeClose(payload[:])
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"bufio"
+	"github.com/sunlidea/ferry/client"
+	"github.com/sunlidea/ferry/server"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Arith int
+
+func (t *Arith) Add(a, b int) (int, error) {
+	return a + b, nil
+}
+
+type ArithProxy struct {
+	Add func(a, b int) (int, error)
+}
+
+// Test ferry calls carried over WebSocket
+func TestDial(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestDial|Register|Fail|%v", err)
+		return
+	}
+	ts := httptest.NewServer(Handler(s.ServeConn))
+	defer ts.Close()
+
+	conn, err := Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ferry", nil, nil)
+	if err != nil {
+		t.Fatalf("TestDial|Dial|Fail|%v", err)
+		return
+	}
+	c := client.NewClient(conn, "Arith", new(ArithProxy))
+	defer c.Close()
+	proxy := c.GetService().(*ArithProxy)
+	for i := 0; i < 10; i++ {
+		sum, err := proxy.Add(i, 1)
+		if err != nil || sum != i+1 {
+			t.Fatalf("TestDial|Add|Fail|%v|%d", err, sum)
+			return
+		}
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("TestDial|plain GET|Fail|%v|%v", err, resp)
+		return
+	}
+	resp.Body.Close()
+
+	if _, err := Dial("http"+strings.TrimPrefix(ts.URL, "http"), nil, nil); err == nil {
+		t.Fatalf("TestDial|scheme|Fail|no error")
+	}
+}
+
+// Test a websocket connection outliving the timeouts of the HTTP server
+func TestDial_HTTPTimeout(t *testing.T) {
+	s := server.NewServer()
+	if err := s.Register(new(Arith)); err != nil {
+		t.Fatalf("TestDial_HTTPTimeout|Register|Fail|%v", err)
+		return
+	}
+	ts := httptest.NewUnstartedServer(Handler(s.ServeConn))
+	ts.Config.ReadTimeout = 50 * time.Millisecond
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ferry", nil, nil)
+	if err != nil {
+		t.Fatalf("TestDial_HTTPTimeout|Dial|Fail|%v", err)
+		return
+	}
+	c := client.NewClient(conn, "Arith", new(ArithProxy))
+	defer c.Close()
+	proxy := c.GetService().(*ArithProxy)
+
+	// the first call comes after the HTTP timeouts
+	time.Sleep(150 * time.Millisecond)
+	if sum, err := proxy.Add(3, 4); err != nil || sum != 7 {
+		t.Fatalf("TestDial_HTTPTimeout|Add|Fail|%v|%d", err, sum)
+	}
+}
+
+// Test fragmented messages, pings and the close handshake
+func TestConn_Frames(t *testing.T) {
+	a, b := net.Pipe()
+	cli := newConn(a, bufio.NewReader(a), true)
+	srv := newConn(b, bufio.NewReader(b), false)
+
+	pongs := make(chan error, 1)
+	go func() {
+		// the client reads the pong, then the echo of its close frame
+		_, err := io.ReadAll(cli)
+		pongs <- err
+	}()
+	go func() {
+		cli.writeFrame(false, opBinary, []byte("fer"))
+		cli.writeFrame(true, opPing, []byte("ping"))
+		cli.writeFrame(true, opContinuation, []byte("ry"))
+		cli.writeFrame(true, opBinary, nil)
+		cli.Write([]byte("!"))
+		cli.writeClose([]byte{0x03, 0xe8})
+	}()
+
+	data, err := io.ReadAll(srv)
+	if err != nil || string(data) != "ferry!" {
+		t.Fatalf("TestConn_Frames|ReadAll|Fail|%v|%q", err, data)
+		return
+	}
+	if _, err := srv.Write([]byte("late")); err != ErrClosed {
+		t.Fatalf("TestConn_Frames|Write after close|Fail|%v", err)
+		return
+	}
+	srv.Close()
+	if err := <-pongs; err != nil {
+		t.Fatalf("TestConn_Frames|client|Fail|%v", err)
+	}
+}
+
+// Test frames breaking the protocol are rejected
+func TestConn_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame func(c *Conn)
+	}{
+		{"text", func(c *Conn) { c.writeFrame(true, opText, []byte("hi")) }},
+		{"continuation", func(c *Conn) { c.writeFrame(true, opContinuation, []byte("hi")) }},
+		{"fragmented ping", func(c *Conn) { c.writeFrame(false, opPing, nil) }},
+		{"unmasked", func(c *Conn) { c.client = false; c.writeFrame(true, opBinary, []byte("hi")) }},
+	}
+	for _, test := range tests {
+		a, b := net.Pipe()
+		cli := newConn(a, bufio.NewReader(a), true)
+		srv := newConn(b, bufio.NewReader(b), false)
+		go io.Copy(io.Discard, a)
+		go test.frame(cli)
+		if _, err := srv.Read(make([]byte, 8)); err == nil || err == io.EOF {
+			t.Fatalf("TestConn_Invalid|%s|Fail|%v", test.name, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}